@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AdminService is a HTTP API for inspecting and managing a running Shuttle.
+// It is not a Service since it does not receive files.
+type AdminService struct {
+	host           string
+	port           int
+	allowInsecure  bool
+	missionControl *MissionControl
+	reload         func() error
+	server         *http.Server
+}
+
+// QueuedShuttle is a shuttle as returned by the admin API.
+type QueuedShuttle struct {
+	TransferID  string     `json:"transfer_id"`
+	Path        string     `json:"path"`
+	Username    string     `json:"username"`
+	Endpoint    string     `json:"endpoint"`
+	Created     time.Time  `json:"created"`
+	Attempts    int        `json:"attempts"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Enroute     bool       `json:"enroute"`
+	Launched    *time.Time `json:"launched,omitempty"`
+	Deliveries  []Delivery `json:"deliveries,omitempty"`
+}
+
+// RequeueResult is the result of requeueing a single failed file as returned by the admin API.
+type RequeueResult struct {
+	Filename   string `json:"filename"`
+	Path       string `json:"path,omitempty"`
+	TransferID string `json:"transfer_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// RouteSummary is the state of a route as returned by the admin API.
+type RouteSummary struct {
+	Username string `json:"username"`
+	Endpoint string `json:"endpoint"`
+	Local    bool   `json:"local"`
+	Queued   int    `json:"queued"`
+	Enroute  int    `json:"enroute"`
+	Failed   int    `json:"failed"`
+}
+
+// secretFields are the configuration fields that are never returned by the admin API.
+var secretFields = map[string]bool{
+	"password":       true,
+	"bearer_token":   true,
+	"client_secret":  true,
+	"signing_secret": true,
+}
+
+// NewAdminService creates a new AdminService. The reload function is called to reload the configuration.
+func NewAdminService(host string, port int, allowInsecure bool, missionControl *MissionControl, reload func() error) *AdminService {
+	return &AdminService{
+		host:           host,
+		port:           port,
+		allowInsecure:  allowInsecure,
+		missionControl: missionControl,
+		reload:         reload,
+	}
+}
+
+// Start starts the service.
+func (s *AdminService) Start() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/queue", s.auth(s.serveQueue))
+	mux.HandleFunc("/queue/retry", s.auth(s.handleRetry))
+	mux.HandleFunc("/queue/cancel", s.auth(s.handleCancel))
+	mux.HandleFunc("/routes", s.auth(s.serveRoutes))
+	mux.HandleFunc("/failed", s.auth(s.serveFailed))
+	mux.HandleFunc("/failed/requeue", s.auth(s.handleRequeue))
+	mux.HandleFunc("/history", s.auth(s.serveHistory))
+	mux.HandleFunc("/services", s.auth(s.serveServices))
+	mux.HandleFunc("/config", s.auth(s.serveConfiguration))
+	mux.HandleFunc("/reload", s.auth(s.handleReload))
+
+	// Metrics and health checks do not contain secrets, so they can be used without credentials
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/health/live", serveHealth(s.missionControl.Liveness))
+	mux.HandleFunc("/health/ready", serveHealth(s.missionControl.Readiness))
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.host, s.port))
+	if err != nil {
+		return err
+	}
+
+	if !s.allowInsecure {
+		listener = tls.NewListener(listener, &tls.Config{
+			Certificates: []tls.Certificate{s.missionControl.Configuration().Certificate},
+			MinVersion:   tls.VersionTLS12,
+		})
+	}
+
+	s.server = &http.Server{
+		Handler: mux,
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("Admin service crashed")
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the service gracefully.
+func (s *AdminService) Stop() error {
+	return s.server.Shutdown(context.Background())
+}
+
+func (s *AdminService) auth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		credentials := s.missionControl.Configuration().Admin
+		username, password, _ := request.BasicAuth()
+
+		if credentials.Username != "" && subtle.ConstantTimeCompare([]byte(username), []byte(credentials.Username)) == 1 {
+			if err := bcrypt.CompareHashAndPassword([]byte(credentials.Password), []byte(password)); err == nil {
+				handler(writer, request)
+				return
+			}
+		}
+
+		authFailures.WithLabelValues("admin").Inc()
+
+		writer.Header().Set("WWW-Authenticate", `Basic realm="Shuttle admin"`)
+		writeJSONError(writer, http.StatusUnauthorized, "Unauthorized")
+	}
+}
+
+func (s *AdminService) serveQueue(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writeJSONError(writer, http.StatusMethodNotAllowed, "Invalid method")
+		return
+	}
+
+	username := request.URL.Query().Get("username")
+	shuttles, inFlight := s.missionControl.Launchpad.Snapshot()
+
+	queued := []QueuedShuttle{}
+	for _, shuttle := range sortedShuttles(shuttles, username) {
+		entry := QueuedShuttle{
+			TransferID: shuttle.TransferID,
+			Path:       shuttle.Path,
+			Username:   shuttle.Route.Username,
+			Endpoint:   shuttle.Endpoints(),
+			Created:    shuttle.Created,
+			Attempts:   shuttle.Attempts,
+			LastError:  shuttle.LastError,
+			Deliveries: shuttle.Deliveries,
+		}
+
+		if !shuttle.NextAttempt.IsZero() {
+			nextAttempt := shuttle.NextAttempt
+			entry.NextAttempt = &nextAttempt
+		}
+
+		if launched, enroute := inFlight[shuttle.Path]; enroute {
+			entry.Enroute = true
+			entry.Launched = &launched
+		}
+
+		queued = append(queued, entry)
+	}
+
+	writeJSON(writer, http.StatusOK, queued)
+}
+
+func (s *AdminService) handleRetry(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		writeJSONError(writer, http.StatusMethodNotAllowed, "Invalid method")
+		return
+	}
+
+	path := request.FormValue("path")
+	if err := s.missionControl.Launchpad.RetryShuttle(path); err != nil {
+		writeLaunchpadError(writer, err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"path": path,
+	}).Info("Shuttle retry requested through admin API")
+
+	writeJSON(writer, http.StatusOK, map[string]string{"path": path})
+}
+
+func (s *AdminService) handleCancel(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		writeJSONError(writer, http.StatusMethodNotAllowed, "Invalid method")
+		return
+	}
+
+	path := request.FormValue("path")
+	if err := s.missionControl.Launchpad.CancelShuttle(path, "Cancelled by an operator"); err != nil {
+		writeLaunchpadError(writer, err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"path": path,
+	}).Info("Shuttle cancelled through admin API")
+
+	writeJSON(writer, http.StatusOK, map[string]string{"path": path})
+}
+
+func (s *AdminService) serveRoutes(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writeJSONError(writer, http.StatusMethodNotAllowed, "Invalid method")
+		return
+	}
+
+	configuration := s.missionControl.Configuration()
+	shuttles, inFlight := s.missionControl.Launchpad.Snapshot()
+
+	summaries := []RouteSummary{}
+	for _, route := range configuration.Routes {
+		summary := RouteSummary{
+			Username: route.Username,
+			Endpoint: route.Endpoints(),
+			Local:    route.Local,
+		}
+
+		for path, shuttle := range shuttles {
+			if shuttle.Route.Username != route.Username {
+				continue
+			}
+
+			if _, enroute := inFlight[path]; enroute {
+				summary.Enroute++
+			} else {
+				summary.Queued++
+			}
+		}
+
+		if failedFiles, err := ListFailed(configuration.Base, route.Username); err == nil {
+			summary.Failed = len(failedFiles)
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	writeJSON(writer, http.StatusOK, summaries)
+}
+
+func (s *AdminService) serveFailed(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writeJSONError(writer, http.StatusMethodNotAllowed, "Invalid method")
+		return
+	}
+
+	configuration := s.missionControl.Configuration()
+	username := request.URL.Query().Get("username")
+
+	failed := []FailedFile{}
+	for _, route := range configuration.Routes {
+		if username != "" && route.Username != username {
+			continue
+		}
+
+		failedFiles, err := ListFailed(configuration.Base, route.Username)
+		if err != nil {
+			writeJSONError(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		failed = append(failed, failedFiles...)
+	}
+
+	writeJSON(writer, http.StatusOK, failed)
+}
+
+func (s *AdminService) serveHistory(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writeJSONError(writer, http.StatusMethodNotAllowed, "Invalid method")
+		return
+	}
+
+	history := s.missionControl.Launchpad.History
+	if history == nil {
+		writeJSONError(writer, http.StatusNotFound, "History is not enabled")
+		return
+	}
+
+	query := request.URL.Query()
+	filter, err := NewHistoryFilter(query.Get("username"), query.Get("filename"), query.Get("since"), query.Get("until"))
+	if err != nil {
+		writeJSONError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, err := history.Query(filter)
+	if err != nil {
+		writeJSONError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, entries)
+}
+
+func (s *AdminService) handleRequeue(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		writeJSONError(writer, http.StatusMethodNotAllowed, "Invalid method")
+		return
+	}
+
+	configuration := s.missionControl.Configuration()
+	username := request.FormValue("username")
+
+	route, found := FindRoute(configuration.Routes, username)
+	if !found {
+		writeJSONError(writer, http.StatusNotFound, "Route not found")
+		return
+	}
+
+	failedFiles, err := ListFailed(configuration.Base, username)
+	if err != nil && !os.IsNotExist(err) {
+		writeJSONError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// The metadata of the failed files carries their transfer IDs and requeue counts over
+	files := make(map[string]FailedFile)
+	for _, file := range failedFiles {
+		files[file.Name] = file
+	}
+
+	// Requeue the given files or everything in the failed folder
+	filenames := request.Form["filename"]
+	if len(filenames) == 0 {
+		for _, file := range failedFiles {
+			filenames = append(filenames, file.Name)
+		}
+	}
+
+	// A file that cannot be requeued does not stop the rest
+	results := []RequeueResult{}
+	requeued := 0
+
+	for _, filename := range filenames {
+		result := RequeueResult{
+			Filename: filename,
+		}
+
+		file, found := files[filepath.Base(filename)]
+		if !found {
+			result.Error = "File not found in the failed folder"
+			results = append(results, result)
+			continue
+		}
+
+		path, err := RequeueFailed(configuration.Base, username, filename)
+		if err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+
+		shuttle := NewRequeuedShuttle(path, route, file)
+		s.missionControl.receive(shuttle)
+
+		result.Path = path
+		result.TransferID = shuttle.TransferID
+		results = append(results, result)
+		requeued++
+	}
+
+	log.WithFields(log.Fields{
+		"username": username,
+		"count":    requeued,
+		"failed":   len(results) - requeued,
+	}).Info("Failed files requeued through admin API")
+
+	writeJSON(writer, http.StatusOK, results)
+}
+
+func (s *AdminService) serveServices(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writeJSONError(writer, http.StatusMethodNotAllowed, "Invalid method")
+		return
+	}
+
+	statuses := []ServiceStatus{}
+	for _, service := range s.missionControl.Services {
+		statuses = append(statuses, service.Status())
+	}
+
+	writeJSON(writer, http.StatusOK, statuses)
+}
+
+func (s *AdminService) serveConfiguration(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		writeJSONError(writer, http.StatusMethodNotAllowed, "Invalid method")
+		return
+	}
+
+	configuration := s.missionControl.Configuration()
+
+	// Go through JSON so that new route fields are included without listing them here
+	var routes []interface{}
+	encoded, err := json.Marshal(configuration.Routes)
+	if err == nil {
+		err = json.Unmarshal(encoded, &routes)
+	}
+
+	if err != nil {
+		writeJSONError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, map[string]interface{}{
+		"base":               configuration.Base,
+		"routes":             redact(routes),
+		"ftp_host":           configuration.FtpHost,
+		"ftp_port":           configuration.FtpPort,
+		"sftp_host":          configuration.SftpHost,
+		"sftp_port":          configuration.SftpPort,
+		"web_host":           configuration.WebHost,
+		"web_port":           configuration.WebPort,
+		"web_insecure_port":  configuration.WebInsecurePort,
+		"web_allow_insecure": configuration.WebAllowInsecure,
+	})
+}
+
+func (s *AdminService) handleReload(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		writeJSONError(writer, http.StatusMethodNotAllowed, "Invalid method")
+		return
+	}
+
+	log.Info("Reloading configuration through admin API")
+
+	if err := s.reload(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Failed to reload configuration")
+
+		writeJSONError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Info("Configuration reloaded")
+
+	writeJSON(writer, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+// redact replaces secrets in a decoded JSON value, including credentials in endpoint and failover URLs and header values.
+func redact(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			switch {
+			case secretFields[key]:
+				if field != "" {
+					value[key] = "REDACTED"
+				}
+			case key == "headers":
+				if headers, ok := field.(map[string]interface{}); ok {
+					for name := range headers {
+						headers[name] = "REDACTED"
+					}
+				}
+			case key == "endpoint":
+				if endpoint, ok := field.(string); ok {
+					value[key] = redactURL(endpoint)
+				}
+			case key == "failover":
+				if endpoints, ok := field.([]interface{}); ok {
+					for i, endpoint := range endpoints {
+						if endpoint, ok := endpoint.(string); ok {
+							endpoints[i] = redactURL(endpoint)
+						}
+					}
+				}
+			default:
+				value[key] = redact(field)
+			}
+		}
+	case []interface{}:
+		for i, field := range value {
+			value[i] = redact(field)
+		}
+	}
+
+	return value
+}
+
+// redactURL removes the password from the URL.
+func redactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.User == nil {
+		return rawURL
+	}
+
+	if _, hasPassword := parsed.User.Password(); hasPassword {
+		parsed.User = url.UserPassword(parsed.User.Username(), "REDACTED")
+	}
+
+	return parsed.String()
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func writeJSONError(writer http.ResponseWriter, status int, message string) {
+	writeJSON(writer, status, map[string]string{"error": message})
+}
+
+func writeLaunchpadError(writer http.ResponseWriter, err error) {
+	switch err {
+	case ErrShuttleNotFound:
+		writeJSONError(writer, http.StatusNotFound, err.Error())
+	case ErrShuttleEnroute:
+		writeJSONError(writer, http.StatusConflict, err.Error())
+	default:
+		writeJSONError(writer, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Archive is the archive policy of a route. Delivered files are moved to a dated tree
+// within Path instead of being removed, and purged once they are older than MaxAge
+// or the archive grows larger than MaxSize bytes. Zero values disable the purging.
+type Archive struct {
+	Path     string   `json:"path"`
+	Compress bool     `json:"compress"`
+	MaxAge   Duration `json:"max_age"`
+	MaxSize  int64    `json:"max_size"`
+}
+
+// Validate returns an error if the archive cannot be used. The archive must be outside
+// of the base folder so that the archived files are not visible to the users.
+func (a Archive) Validate(base string) error {
+	if a.Path == "" {
+		return errors.New("Archive path is missing")
+	}
+
+	archivePath, err := filepath.Abs(a.Path)
+	if err != nil {
+		return err
+	}
+
+	basePath, err := filepath.Abs(base)
+	if err != nil {
+		return err
+	}
+
+	relative, err := filepath.Rel(basePath, archivePath)
+	if err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return errors.New("Archive path must not be within base")
+	}
+
+	if a.MaxSize < 0 {
+		return errors.New("Archive max_size must not be negative")
+	}
+
+	return nil
+}
+
+// Store moves the delivered file of the shuttle to the archive and returns its path in the archive.
+// The file is named after the transfer ID and the original name so that files with the same name do not collide.
+func (a Archive) Store(shuttle Shuttle) (string, error) {
+	now := time.Now()
+	directory := filepath.Join(a.Path, now.Format("2006"), now.Format("01"), now.Format("02"))
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s-%s", shuttle.TransferID, filepath.Base(shuttle.Path))
+	if a.Compress {
+		name += ".gz"
+	}
+
+	path := filepath.Join(directory, name)
+
+	if a.Compress {
+		if err := compressFile(shuttle.Path, path); err != nil {
+			return "", err
+		}
+
+		if err := os.Remove(shuttle.Path); err != nil {
+			return "", err
+		}
+	} else if err := os.Rename(shuttle.Path, path); err != nil {
+		// Most likely on a different file system
+		if err := copyFile(shuttle.Path, path); err != nil {
+			return "", err
+		}
+
+		if err := os.Remove(shuttle.Path); err != nil {
+			return "", err
+		}
+	}
+
+	// The modification time tells when the file was archived, which is used for purging
+	if err := os.Chtimes(path, now, now); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// Purge removes the archived files that are older than Archive.MaxAge
+// and the oldest files until the archive is no larger than Archive.MaxSize.
+func (a Archive) Purge() (int, error) {
+	type archivedFile struct {
+		path     string
+		size     int64
+		archived time.Time
+	}
+
+	files := []archivedFile{}
+	err := filepath.Walk(a.Path, func(path string, fileinfo os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == a.Path {
+				return filepath.SkipDir
+			}
+
+			return err
+		}
+
+		// Skip the files that are being written
+		if !fileinfo.Mode().IsRegular() || strings.HasPrefix(fileinfo.Name(), ".") {
+			return nil
+		}
+
+		files = append(files, archivedFile{path, fileinfo.Size(), fileinfo.ModTime()})
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].archived.Before(files[j].archived)
+	})
+
+	var total int64
+	for _, file := range files {
+		total += file.size
+	}
+
+	cutoff := time.Now().Add(-time.Duration(a.MaxAge))
+	purged := 0
+
+	for _, file := range files {
+		expired := a.MaxAge > 0 && file.archived.Before(cutoff)
+		oversized := a.MaxSize > 0 && total > a.MaxSize
+
+		if !expired && !oversized {
+			break
+		}
+
+		if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+			return purged, err
+		}
+
+		total -= file.size
+		purged++
+
+		// Remove the dated directories once they are empty, fails harmlessly otherwise
+		for directory := filepath.Dir(file.path); directory != filepath.Clean(a.Path); directory = filepath.Dir(directory) {
+			if os.Remove(directory) != nil {
+				break
+			}
+		}
+	}
+
+	return purged, nil
+}
+
+// compressFile writes a gzip compressed copy of the source file to the destination.
+func compressFile(source string, destination string) error {
+	return writeFile(source, destination, func(writer io.Writer, reader io.Reader) error {
+		compressor := gzip.NewWriter(writer)
+		compressor.Name = filepath.Base(source)
+
+		if _, err := io.Copy(compressor, reader); err != nil {
+			return err
+		}
+
+		return compressor.Close()
+	})
+}
+
+// copyFile writes a copy of the source file to the destination.
+func copyFile(source string, destination string) error {
+	return writeFile(source, destination, func(writer io.Writer, reader io.Reader) error {
+		_, err := io.Copy(writer, reader)
+		return err
+	})
+}
+
+// writeFile writes the source file to a temporary file using fn and renames it to the destination
+// once it is complete, so that a partially written file is never left in the destination.
+func writeFile(source string, destination string, fn func(writer io.Writer, reader io.Reader) error) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+
+	defer input.Close()
+
+	temporaryPath := filepath.Join(filepath.Dir(destination), "."+filepath.Base(destination)+".tmp")
+	output, err := os.OpenFile(temporaryPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(output, input); err != nil {
+		output.Close()
+		os.Remove(temporaryPath)
+		return err
+	}
+
+	if err := output.Sync(); err != nil {
+		output.Close()
+		os.Remove(temporaryPath)
+		return err
+	}
+
+	if err := output.Close(); err != nil {
+		os.Remove(temporaryPath)
+		return err
+	}
+
+	return os.Rename(temporaryPath, destination)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Events recorded in the audit log.
+const (
+	AuditReceived  = "received"
+	AuditQueued    = "queued"
+	AuditAttempted = "attempted"
+	AuditRetrying  = "retrying"
+	AuditDelivered = "delivered"
+	AuditRejected  = "rejected"
+	AuditCompleted = "completed"
+	AuditFailed    = "failed"
+	AuditDiscarded = "discarded"
+)
+
+// auditLog is the audit log that events are recorded in, nil if the audit log is disabled.
+var auditLog *AuditLog
+
+// AuditEvent is a single line of the audit log.
+type AuditEvent struct {
+	Time            time.Time         `json:"time"`
+	Event           string            `json:"event"`
+	TransferID      string            `json:"transfer_id"`
+	Username        string            `json:"username"`
+	Path            string            `json:"path"`
+	Protocol        string            `json:"protocol,omitempty"`
+	ClientIP        string            `json:"client_ip,omitempty"`
+	Size            int64             `json:"size"`
+	SHA256          string            `json:"sha256,omitempty"`
+	Endpoint        string            `json:"endpoint,omitempty"`
+	Destination     string            `json:"destination,omitempty"`
+	Attempt         int               `json:"attempt,omitempty"`
+	Archive         string            `json:"archive,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	StatusCode      int               `json:"status_code,omitempty"`
+	Response        string            `json:"response,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+}
+
+// NewAuditEvent creates a new AuditEvent of the shuttle.
+func NewAuditEvent(event string, shuttle Shuttle) AuditEvent {
+	return AuditEvent{
+		Time:       time.Now().UTC(),
+		Event:      event,
+		TransferID: shuttle.TransferID,
+		Username:   shuttle.Route.Username,
+		Path:       shuttle.Path,
+		Protocol:   shuttle.Protocol,
+		ClientIP:   shuttle.ClientIP,
+		Size:       shuttle.Size,
+		SHA256:     shuttle.SHA256,
+		Endpoint:   shuttle.Endpoints(),
+	}
+}
+
+// NewDeliveryAuditEvent creates a new AuditEvent of the delivery of the shuttle to the destination.
+func NewDeliveryAuditEvent(event string, shuttle Shuttle, destination Destination) AuditEvent {
+	auditEvent := NewAuditEvent(event, shuttle)
+	auditEvent.Endpoint = redactURL(destination.Endpoint)
+	auditEvent.Destination = destination.Name
+
+	return auditEvent
+}
+
+// SetResponse includes the excerpt of the response of the endpoint in the event.
+func (e *AuditEvent) SetResponse(response ResponseExcerpt) {
+	e.StatusCode = response.StatusCode
+	e.Response = response.Body
+	e.ResponseHeaders = response.Headers
+}
+
+// AuditLog is an append-only log of transfer events with one JSON object per line.
+type AuditLog struct {
+	file  *os.File
+	mutex *sync.Mutex
+}
+
+// OpenAuditLog opens the audit log in the given path, creating it if it does not exist.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuditLog{
+		file:  file,
+		mutex: &sync.Mutex{},
+	}, nil
+}
+
+// Record appends the event to the audit log and syncs it to disk. Does nothing if the audit log is nil.
+func (a *AuditLog) Record(event AuditEvent) {
+	if a == nil {
+		return
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Failed to encode audit event")
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.WithFields(log.Fields{
+			"transfer": event.TransferID,
+			"event":    event.Event,
+			"err":      err,
+		}).Error("Failed to write audit event")
+		return
+	}
+
+	if err := a.file.Sync(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Failed to sync audit log")
+	}
+}
+
+// Close closes the audit log.
+func (a *AuditLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.file.Close()
+}
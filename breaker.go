@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// States of the circuit of an endpoint host.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+type circuit struct {
+	state    string
+	failures int
+	opened   time.Time
+	probed   time.Time
+}
+
+// CircuitBreakers keep track of the health of the endpoint hosts. The circuit of a host is opened
+// after Failures consecutive temporary failures, after which the shuttles of the host are parked
+// instead of being sent. Once Cooldown has passed, a single shuttle is let through as a probe
+// and the circuit is closed if it succeeds. If the probe does not report back within Cooldown,
+// e.g. because Shuttle was stopped while sending it, another one is let through. A Failures of zero disables the circuit breakers.
+type CircuitBreakers struct {
+	Failures int
+	Cooldown time.Duration
+	circuits map[string]*circuit
+	mutex    *sync.Mutex
+}
+
+// NewCircuitBreakers creates new CircuitBreakers.
+func NewCircuitBreakers(failures int, cooldown time.Duration) *CircuitBreakers {
+	return &CircuitBreakers{
+		Failures: failures,
+		Cooldown: cooldown,
+		circuits: make(map[string]*circuit),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// Unexported since it relies on CircuitBreakers.mutex being locked
+func (b *CircuitBreakers) circuit(host string) *circuit {
+	c, found := b.circuits[host]
+	if !found {
+		c = &circuit{state: CircuitClosed}
+		b.circuits[host] = c
+	}
+
+	return c
+}
+
+// Allow returns whether a shuttle can be sent to the endpoint right now. If it cannot,
+// the time when the shuttle should be tried again is returned. The times are spread
+// over half of the cooldown so that the parked shuttles do not all wake up at once.
+func (b *CircuitBreakers) Allow(endpoint string) (bool, time.Time) {
+	if b.Failures <= 0 {
+		return true, time.Time{}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	host := endpointLabel(endpoint)
+	c := b.circuit(host)
+	jitter := time.Duration(rand.Int63n(int64(b.Cooldown/2) + 1))
+
+	switch c.state {
+	case CircuitOpen:
+		reopen := c.opened.Add(b.Cooldown)
+		if time.Now().Before(reopen) {
+			return false, reopen.Add(jitter)
+		}
+
+		log.WithFields(log.Fields{
+			"endpoint": host,
+		}).Info("Circuit is half-open, probing endpoint")
+
+		c.state = CircuitHalfOpen
+		c.probed = time.Now()
+
+		return true, time.Time{}
+
+	case CircuitHalfOpen:
+		// The probe has not finished yet, unless it has been lost
+		if time.Now().Before(c.probed.Add(b.Cooldown)) {
+			return false, time.Now().Add(b.Cooldown/2 + jitter)
+		}
+
+		log.WithFields(log.Fields{
+			"endpoint": host,
+		}).Warning("Probe of the endpoint did not finish in time, probing again")
+
+		c.probed = time.Now()
+
+		return true, time.Time{}
+	}
+
+	return true, time.Time{}
+}
+
+// Report updates the circuit of the endpoint host with the result of a send.
+// Temporary failures count against the host, any other result means that the host is up.
+func (b *CircuitBreakers) Report(endpoint string, failed bool) {
+	if b.Failures <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	host := endpointLabel(endpoint)
+	c := b.circuit(host)
+
+	if !failed {
+		if c.state != CircuitClosed {
+			log.WithFields(log.Fields{
+				"endpoint": host,
+			}).Info("Endpoint has recovered, closing circuit")
+		}
+
+		c.state = CircuitClosed
+		c.failures = 0
+		circuitOpen.WithLabelValues(host).Set(0)
+
+		return
+	}
+
+	c.failures++
+
+	// A failed probe opens the circuit right away
+	if c.state == CircuitHalfOpen || (c.state == CircuitClosed && c.failures >= b.Failures) {
+		log.WithFields(log.Fields{
+			"endpoint": host,
+			"failures": c.failures,
+			"cooldown": b.Cooldown,
+		}).Warning("Endpoint keeps failing, opening circuit")
+
+		c.state = CircuitOpen
+		c.opened = time.Now()
+		circuitOpen.WithLabelValues(host).Set(1)
+	}
+}
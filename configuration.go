@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 
@@ -28,22 +29,22 @@ type Configuration struct {
 	WebPort                  int
 	WebInsecurePort          int
 	WebAllowInsecure         bool
+	Admin                    AdminCredentials `json:"admin"`
+}
+
+// AdminCredentials are the credentials for the admin API, the password is hashed using bcrypt.
+type AdminCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
 }
 
 // NewConfiguration returns a new configuration struct.
 func NewConfiguration(path string, privateKeyPath string, certificatePublicPath string, certificatePrivatePath string, ftpHost string, ftpPort int, sftpHost string, sftpPort int, webHost string, webPort int, webInsecurePort int, webAllowInsecure bool) (Configuration, error) {
-	var configuration Configuration
-
-	handle, err := os.Open(path)
+	configuration, err := ReadConfiguration(path)
 	if err != nil {
 		return configuration, err
 	}
 
-	decoder := json.NewDecoder(handle)
-	if err = decoder.Decode(&configuration); err != nil {
-		return configuration, err
-	}
-
 	var private ssh.Signer
 	if privateKeyPath != "" {
 		rawPrivate, err := ioutil.ReadFile(privateKeyPath)
@@ -88,3 +89,41 @@ func NewConfiguration(path string, privateKeyPath string, certificatePublicPath
 
 	return configuration, nil
 }
+
+// ReadConfiguration reads the base folder and the routes from the config file.
+// Unlike NewConfiguration, it does not load the keys and certificates.
+func ReadConfiguration(path string) (Configuration, error) {
+	var configuration Configuration
+
+	handle, err := os.Open(path)
+	if err != nil {
+		return configuration, err
+	}
+
+	defer handle.Close()
+
+	decoder := json.NewDecoder(handle)
+	if err := decoder.Decode(&configuration); err != nil {
+		return configuration, err
+	}
+
+	for _, route := range configuration.Routes {
+		if err := route.Validate(); err != nil {
+			return configuration, fmt.Errorf("Route %s: %v", route.Username, err)
+		}
+
+		if route.Archive != nil {
+			if err := route.Archive.Validate(configuration.Base); err != nil {
+				return configuration, fmt.Errorf("Route %s: %v", route.Username, err)
+			}
+		}
+
+		if route.Failed != nil {
+			if err := route.Failed.Validate(); err != nil {
+				return configuration, fmt.Errorf("Route %s: %v", route.Username, err)
+			}
+		}
+	}
+
+	return configuration, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Delivery statuses of a shuttle to a single destination.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Destination is an endpoint that the files of a route are delivered to, along with its
+// credentials and policy. The file is done once every destination that is not optional has accepted it.
+type Destination struct {
+	Name              string            `json:"name"`
+	Endpoint          string            `json:"endpoint"`
+	Failover          []string          `json:"failover"`
+	FailoverAfter     int               `json:"failover_after"`
+	FailoverProbe     Duration          `json:"failover_probe"`
+	Optional          bool              `json:"optional"`
+	Headers           map[string]string `json:"headers"`
+	BearerToken       string            `json:"bearer_token"`
+	BearerTokenFile   string            `json:"bearer_token_file"`
+	BearerTokenEnv    string            `json:"bearer_token_env"`
+	OAuth2            *OAuth2           `json:"oauth2"`
+	ClientCertificate string            `json:"client_certificate"`
+	ClientKey         string            `json:"client_key"`
+	CABundle          string            `json:"ca_bundle"`
+	PinnedFingerprint string            `json:"pinned_fingerprint"`
+	SigningSecret     string            `json:"signing_secret"`
+	Policy            Policy            `json:"policy"`
+	RateLimit         *RateLimit        `json:"rate_limit"`
+	MaxAttempts       int               `json:"max_attempts"`
+	MaxAge            Duration          `json:"max_age"`
+}
+
+// Delivery is the retry state of a shuttle for a single destination. Endpoint is the endpoint
+// the file was last sent to with the password removed, which differs from the configured one after a failover.
+type Delivery struct {
+	Destination string    `json:"destination"`
+	Endpoint    string    `json:"endpoint,omitempty"`
+	Status      string    `json:"status"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	Reserved    bool      `json:"reserved,omitempty"`
+}
+
+// Validate returns an error if the policy, the rate limit, the retry limits or the failover settings of the destination are invalid.
+func (d Destination) Validate() error {
+	if err := d.Policy.Validate(); err != nil {
+		return err
+	}
+
+	if d.MaxAttempts < 0 {
+		return errors.New("Max_attempts must not be negative")
+	}
+
+	if d.RateLimit != nil {
+		if err := d.RateLimit.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return d.validateFailover()
+}
+
+// Token returns the bearer token of the destination or an empty string if there is none.
+// The token file and environment variable are read on every call so that
+// the token can be rotated without reloading the configuration.
+// OAuth2 access tokens are cached until they expire, refresh forces a new one.
+func (d Destination) Token(refresh bool) (string, error) {
+	if d.OAuth2 != nil {
+		return d.OAuth2.Token(refresh)
+	}
+
+	if d.BearerToken != "" {
+		return d.BearerToken, nil
+	}
+
+	if d.BearerTokenFile != "" {
+		token, err := ioutil.ReadFile(d.BearerTokenFile)
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(token)), nil
+	}
+
+	if d.BearerTokenEnv != "" {
+		token, found := os.LookupEnv(d.BearerTokenEnv)
+		if !found {
+			return "", errors.New("Bearer token environment variable is not set")
+		}
+
+		return strings.TrimSpace(token), nil
+	}
+
+	return "", nil
+}
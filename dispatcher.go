@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+)
+
+// routeQueue is the FIFO queue of the due shuttles of a single route.
+type routeQueue struct {
+	shuttles []Shuttle
+	active   int
+	limit    int
+	weight   int
+	turns    int
+}
+
+// Dispatcher hands the due shuttles to the workers. Every route has a queue of its own so that
+// a route with a lot of files does not hold up the others. The routes take turns in a weighted
+// round-robin, a route gets Route.Weight shuttles per round, and a route never has more than
+// Route.MaxConcurrency shuttles handed out at the same time. Within a route the shuttles stay in order.
+type Dispatcher struct {
+	queues map[string]*routeQueue
+	order  []string
+	next   int
+	mutex  *sync.Mutex
+	cond   *sync.Cond
+}
+
+// NewDispatcher creates a new, empty Dispatcher.
+func NewDispatcher() *Dispatcher {
+	mutex := &sync.Mutex{}
+
+	return &Dispatcher{
+		queues: make(map[string]*routeQueue),
+		mutex:  mutex,
+		cond:   sync.NewCond(mutex),
+	}
+}
+
+// Push adds the shuttle to the end of the queue of its route.
+func (d *Dispatcher) Push(shuttle Shuttle) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	username := shuttle.Route.Username
+
+	queue, found := d.queues[username]
+	if !found {
+		queue = &routeQueue{}
+		d.queues[username] = queue
+		d.order = append(d.order, username)
+	}
+
+	// The latest configuration of the route applies
+	queue.limit = shuttle.Route.MaxConcurrency
+	queue.weight = shuttle.Route.Weight
+	if queue.weight <= 0 {
+		queue.weight = 1
+	}
+
+	queue.shuttles = append(queue.shuttles, shuttle)
+	d.cond.Signal()
+}
+
+// Pop returns the next shuttle to launch, blocking until there is one.
+// Done must be called with the shuttle once it has been handled.
+func (d *Dispatcher) Pop() Shuttle {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for {
+		if shuttle, found := d.take(); found {
+			return shuttle
+		}
+
+		d.cond.Wait()
+	}
+}
+
+// Done releases the concurrency slot of a shuttle returned by Pop.
+func (d *Dispatcher) Done(shuttle Shuttle) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if queue, found := d.queues[shuttle.Route.Username]; found && queue.active > 0 {
+		queue.active--
+	}
+
+	d.cond.Signal()
+}
+
+// Unexported since it relies on Dispatcher.mutex being locked
+func (d *Dispatcher) take() (Shuttle, bool) {
+	for i := 0; i < len(d.order); i++ {
+		queue := d.queues[d.order[d.next]]
+
+		if len(queue.shuttles) > 0 && (queue.limit <= 0 || queue.active < queue.limit) {
+			shuttle := queue.shuttles[0]
+			queue.shuttles[0] = Shuttle{}
+			queue.shuttles = queue.shuttles[1:]
+			queue.active++
+
+			// Stay on the route until it has used up its turns for this round
+			queue.turns++
+			if queue.turns >= queue.weight {
+				queue.turns = 0
+				d.next = (d.next + 1) % len(d.order)
+			}
+
+			return shuttle, true
+		}
+
+		queue.turns = 0
+		d.next = (d.next + 1) % len(d.order)
+	}
+
+	return Shuttle{}, false
+}
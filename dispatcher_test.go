@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// popAll pops the given amount of shuttles and returns their paths, calling Done on each one.
+func popAll(dispatcher *Dispatcher, count int) []string {
+	paths := []string{}
+
+	for i := 0; i < count; i++ {
+		shuttle := dispatcher.Pop()
+		paths = append(paths, shuttle.Path)
+		dispatcher.Done(shuttle)
+	}
+
+	return paths
+}
+
+func TestDispatcherTakesTurns(t *testing.T) {
+	dispatcher := NewDispatcher()
+
+	busy := Route{Username: "busy"}
+	quiet := Route{Username: "quiet"}
+
+	for _, path := range []string{"busy1", "busy2", "busy3"} {
+		dispatcher.Push(NewShuttle(path, busy))
+	}
+
+	dispatcher.Push(NewShuttle("quiet1", quiet))
+
+	expected := []string{"busy1", "quiet1", "busy2", "busy3"}
+	if paths := popAll(dispatcher, len(expected)); !equalPaths(paths, expected) {
+		t.Errorf("Shuttles were handed out in order %v, expected %v", paths, expected)
+	}
+}
+
+func TestDispatcherWeight(t *testing.T) {
+	dispatcher := NewDispatcher()
+
+	heavy := Route{Username: "heavy", Weight: 2}
+	light := Route{Username: "light"}
+
+	for _, path := range []string{"heavy1", "heavy2", "heavy3", "heavy4"} {
+		dispatcher.Push(NewShuttle(path, heavy))
+	}
+
+	for _, path := range []string{"light1", "light2"} {
+		dispatcher.Push(NewShuttle(path, light))
+	}
+
+	expected := []string{"heavy1", "heavy2", "light1", "heavy3", "heavy4", "light2"}
+	if paths := popAll(dispatcher, len(expected)); !equalPaths(paths, expected) {
+		t.Errorf("Shuttles were handed out in order %v, expected %v", paths, expected)
+	}
+}
+
+func TestDispatcherMaxConcurrency(t *testing.T) {
+	dispatcher := NewDispatcher()
+	route := Route{Username: "limited", MaxConcurrency: 1}
+
+	dispatcher.Push(NewShuttle("first", route))
+	dispatcher.Push(NewShuttle("second", route))
+
+	first := dispatcher.Pop()
+
+	popped := make(chan Shuttle)
+	go func() {
+		popped <- dispatcher.Pop()
+	}()
+
+	select {
+	case shuttle := <-popped:
+		t.Fatalf("Expected %s to wait for a free slot", shuttle.Path)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	dispatcher.Done(first)
+
+	select {
+	case shuttle := <-popped:
+		if shuttle.Path != "second" {
+			t.Errorf("Expected second to be handed out, got %s", shuttle.Path)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the shuttle to be handed out once the slot was freed")
+	}
+}
+
+func equalPaths(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
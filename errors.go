@@ -1,8 +1,23 @@
 package main
 
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrShuttleNotFound is returned when a shuttle is not in the launchpad.
+	ErrShuttleNotFound = errors.New("Shuttle not found")
+	// ErrShuttleEnroute is returned when a shuttle cannot be modified because it is being sent.
+	ErrShuttleEnroute = errors.New("Shuttle is enroute")
+)
+
+// TransportError is returned when a shuttle fails to reach its destination.
+// RetryAfter is the delay requested by the endpoint for temporary errors, if any.
 type TransportError struct {
-	Cause     error
-	Temporary bool
+	Cause      error
+	Temporary  bool
+	RetryAfter time.Duration
 }
 
 func NewTransportError(cause error, temporary bool) TransportError {
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Suffixes of the sidecar files that are written next to the files in the failed folder.
+// Older versions wrote the reason as plain text instead of the JSON metadata.
+const (
+	failureSuffix       = ".failure.json"
+	legacyFailureSuffix = ".reason"
+)
+
+// Failure is the metadata of a file in the failed folder, it is written next to the file.
+// Response is the beginning of the response body of the endpoint, if it responded.
+type Failure struct {
+	TransferID      string            `json:"transfer_id,omitempty"`
+	Reason          string            `json:"reason"`
+	StatusCode      int               `json:"status_code,omitempty"`
+	Response        string            `json:"response,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	Endpoint        string            `json:"endpoint,omitempty"`
+	Attempts        int               `json:"attempts"`
+	Requeues        int               `json:"requeues"`
+	Failed          time.Time         `json:"failed"`
+}
+
+// FailedPolicy is the retention policy of the failed folder of a route. Files that failed longer than
+// RequeueAfter ago are requeued automatically, up to MaxRequeues times. Files are removed once they are
+// older than MaxAge, after which the oldest files are removed until the folder has no more than MaxCount
+// files and MaxSize bytes. Zero values disable the rules.
+type FailedPolicy struct {
+	MaxAge       Duration `json:"max_age"`
+	MaxCount     int      `json:"max_count"`
+	MaxSize      int64    `json:"max_size"`
+	RequeueAfter Duration `json:"requeue_after"`
+	MaxRequeues  int      `json:"max_requeues"`
+}
+
+// Validate returns an error if the policy has negative limits.
+func (p FailedPolicy) Validate() error {
+	if p.MaxAge < 0 || p.MaxCount < 0 || p.MaxSize < 0 || p.RequeueAfter < 0 || p.MaxRequeues < 0 {
+		return errors.New("Failed folder limits must not be negative")
+	}
+
+	return nil
+}
+
+// Requeue returns true if the file should be requeued automatically.
+func (p FailedPolicy) Requeue(file FailedFile) bool {
+	if p.RequeueAfter <= 0 {
+		return false
+	}
+
+	// Requeue once by default so that files are not requeued forever
+	limit := p.MaxRequeues
+	if limit == 0 {
+		limit = 1
+	}
+
+	return file.Requeues < limit && time.Since(file.Failed) >= time.Duration(p.RequeueAfter)
+}
+
+// Expired returns the files that should be removed, the files must be sorted by the time they failed.
+func (p FailedPolicy) Expired(files []FailedFile) []FailedFile {
+	var total int64
+	for _, file := range files {
+		total += file.Size
+	}
+
+	cutoff := time.Now().Add(-time.Duration(p.MaxAge))
+	count := len(files)
+
+	expired := []FailedFile{}
+	for _, file := range files {
+		tooOld := p.MaxAge > 0 && file.Failed.Before(cutoff)
+		tooMany := p.MaxCount > 0 && count > p.MaxCount
+		tooLarge := p.MaxSize > 0 && total > p.MaxSize
+
+		if !tooOld && !tooMany && !tooLarge {
+			break
+		}
+
+		expired = append(expired, file)
+		total -= file.Size
+		count--
+	}
+
+	return expired
+}
+
+// FailedFile is a file in the failed folder of a user.
+type FailedFile struct {
+	Username        string            `json:"username"`
+	Name            string            `json:"name"`
+	Size            int64             `json:"size"`
+	Failed          time.Time         `json:"failed"`
+	Reason          string            `json:"reason"`
+	TransferID      string            `json:"transfer_id,omitempty"`
+	StatusCode      int               `json:"status_code,omitempty"`
+	Response        string            `json:"response,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	Requeues        int               `json:"requeues"`
+}
+
+// isFailureSidecar returns true if the file is metadata of another file in the failed folder.
+func isFailureSidecar(name string) bool {
+	return strings.HasSuffix(name, failureSuffix) || strings.HasSuffix(name, legacyFailureSuffix)
+}
+
+// ListFailed returns the files in the failed folder of the user, oldest failure first.
+func ListFailed(base string, username string) ([]FailedFile, error) {
+	failedFiles := []FailedFile{}
+	failed := filepath.Join(base, username, "failed")
+
+	files, err := ioutil.ReadDir(failed)
+	if err != nil {
+		return failedFiles, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || isFailureSidecar(file.Name()) {
+			continue
+		}
+
+		failedFile := FailedFile{
+			Username: username,
+			Name:     file.Name(),
+			Size:     file.Size(),
+			Failed:   file.ModTime(),
+		}
+
+		if failure, err := readFailure(filepath.Join(failed, file.Name())); err == nil {
+			failedFile.Failed = failure.Failed
+			failedFile.Reason = failure.Reason
+			failedFile.TransferID = failure.TransferID
+			failedFile.StatusCode = failure.StatusCode
+			failedFile.Response = failure.Response
+			failedFile.ResponseHeaders = failure.ResponseHeaders
+			failedFile.Requeues = failure.Requeues
+		}
+
+		failedFiles = append(failedFiles, failedFile)
+	}
+
+	sort.Slice(failedFiles, func(i, j int) bool {
+		return failedFiles[i].Failed.Before(failedFiles[j].Failed)
+	})
+
+	return failedFiles, nil
+}
+
+// readFailure reads the metadata of a file in the failed folder.
+func readFailure(path string) (Failure, error) {
+	var failure Failure
+
+	data, err := ioutil.ReadFile(path + failureSuffix)
+	if err == nil {
+		err = json.Unmarshal(data, &failure)
+		return failure, err
+	}
+
+	// Moving the file keeps its modification time, the legacy reason file tells when it failed
+	legacyPath := path + legacyFailureSuffix
+	reasonInfo, err := os.Stat(legacyPath)
+	if err != nil {
+		return failure, err
+	}
+
+	reason, err := ioutil.ReadFile(legacyPath)
+	if err != nil {
+		return failure, err
+	}
+
+	failure.Reason = strings.TrimSpace(string(reason))
+	failure.Failed = reasonInfo.ModTime()
+
+	return failure, nil
+}
+
+// writeFailure writes the metadata of a file in the failed folder.
+func writeFailure(path string, failure Failure) error {
+	data, err := json.MarshalIndent(failure, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path+failureSuffix, append(data, '\n'), 0644)
+}
+
+// NewRequeuedShuttle creates a new Shuttle of a file requeued from the failed folder to the given path.
+// The transfer ID is kept so that the file can be followed through the requeue, and the requeue is counted.
+func NewRequeuedShuttle(path string, route Route, file FailedFile) Shuttle {
+	shuttle := NewShuttle(path, route)
+	if file.TransferID != "" {
+		shuttle.TransferID = file.TransferID
+	}
+
+	shuttle.Protocol = "requeue"
+	shuttle.Requeues = file.Requeues + 1
+
+	return shuttle
+}
+
+// RemoveFailed removes a file and its metadata from the failed folder of the user.
+func RemoveFailed(base string, username string, filename string) error {
+	path := filepath.Join(base, username, "failed", filepath.Base(filename))
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	// Not crucial, the metadata is useless without the file
+	os.Remove(path + failureSuffix)
+	os.Remove(path + legacyFailureSuffix)
+
+	return nil
+}
+
+// RequeueFailed moves a file from the failed folder of the user back to the user folder.
+// Returns the new path of the file.
+func RequeueFailed(base string, username string, filename string) (string, error) {
+	filename = filepath.Base(filename)
+
+	directory := filepath.Join(base, username)
+	failed := filepath.Join(directory, "failed")
+
+	destination := filepath.Join(directory, filename)
+	if _, err := os.Stat(destination); err == nil {
+		return "", fmt.Errorf("%s already exists in the user folder", filename)
+	}
+
+	if err := os.Rename(filepath.Join(failed, filename), destination); err != nil {
+		return "", err
+	}
+
+	// Not crucial, the metadata is only informational
+	os.Remove(filepath.Join(failed, filename+failureSuffix))
+	os.Remove(filepath.Join(failed, filename+legacyFailureSuffix))
+
+	return destination, nil
+}
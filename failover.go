@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of the failover settings of a destination.
+const (
+	defaultFailoverAfter = 3
+	defaultFailoverProbe = time.Minute
+)
+
+type failoverState struct {
+	active   int
+	failures int
+	probed   time.Time
+}
+
+// failoverStates holds the active endpoint of every destination that has failover endpoints,
+// shared by all shuttles so that one failing file moves the rest of them as well.
+var failoverStates = struct {
+	states map[string]*failoverState
+	mutex  *sync.Mutex
+}{
+	states: make(map[string]*failoverState),
+	mutex:  &sync.Mutex{},
+}
+
+// Endpoints returns the primary endpoint of the destination followed by its failover endpoints.
+func (d Destination) Endpoints() []string {
+	return append([]string{d.Endpoint}, d.Failover...)
+}
+
+func (d Destination) failoverAfter() int {
+	if d.FailoverAfter > 0 {
+		return d.FailoverAfter
+	}
+
+	return defaultFailoverAfter
+}
+
+func (d Destination) failoverProbe() time.Duration {
+	if d.FailoverProbe > 0 {
+		return time.Duration(d.FailoverProbe)
+	}
+
+	return defaultFailoverProbe
+}
+
+func (d Destination) validateFailover() error {
+	for _, endpoint := range d.Failover {
+		if endpoint == "" {
+			return errors.New("Failover endpoint is empty")
+		}
+	}
+
+	if d.FailoverAfter < 0 {
+		return errors.New("Failover_after must not be negative")
+	}
+
+	if d.FailoverProbe < 0 {
+		return errors.New("Failover_probe must not be negative")
+	}
+
+	return nil
+}
+
+// Unexported since it relies on the failoverStates mutex being locked
+func (d Destination) failoverState() *failoverState {
+	key := strings.Join(d.Endpoints(), "\n")
+
+	state, found := failoverStates.states[key]
+	if !found {
+		state = &failoverState{}
+		failoverStates.states[key] = state
+	}
+
+	return state
+}
+
+// SelectEndpoint returns the endpoint that the next file should be sent to. After the destination
+// has failed over, every FailoverProbe one file is sent to the primary endpoint to see whether it has recovered.
+func (d Destination) SelectEndpoint() string {
+	if len(d.Failover) == 0 {
+		return d.Endpoint
+	}
+
+	failoverStates.mutex.Lock()
+	defer failoverStates.mutex.Unlock()
+
+	endpoints := d.Endpoints()
+	state := d.failoverState()
+
+	if state.active != 0 && time.Since(state.probed) >= d.failoverProbe() {
+		state.probed = time.Now()
+		return endpoints[0]
+	}
+
+	return endpoints[state.active]
+}
+
+// ReportEndpoint updates the failover state of the destination with the result of a send to the endpoint.
+// Temporary failures count towards failing over to the next endpoint, any other result means that the endpoint is up.
+func (d Destination) ReportEndpoint(endpoint string, temporary bool) {
+	if len(d.Failover) == 0 {
+		return
+	}
+
+	failoverStates.mutex.Lock()
+	defer failoverStates.mutex.Unlock()
+
+	endpoints := d.Endpoints()
+	state := d.failoverState()
+
+	index := -1
+	for i, candidate := range endpoints {
+		if candidate == endpoint {
+			index = i
+			break
+		}
+	}
+
+	if !temporary {
+		if index == 0 && state.active != 0 {
+			log.WithFields(log.Fields{
+				"endpoint": redactURL(endpoints[0]),
+			}).Info("Primary endpoint has recovered, failing back")
+
+			state.active = 0
+		}
+
+		if index == state.active {
+			state.failures = 0
+		}
+
+		return
+	}
+
+	// A failed probe of the primary endpoint does not count against the active one
+	if index != state.active {
+		return
+	}
+
+	state.failures++
+	if state.failures < d.failoverAfter() {
+		return
+	}
+
+	next := (state.active + 1) % len(endpoints)
+
+	log.WithFields(log.Fields{
+		"endpoint": redactURL(endpoints[state.active]),
+		"next":     redactURL(endpoints[next]),
+		"failures": state.failures,
+	}).Warning("Endpoint keeps failing, failing over to the next endpoint")
+
+	failovers.WithLabelValues(endpointLabel(endpoints[0])).Inc()
+
+	state.active = next
+	state.failures = 0
+	state.probed = time.Now()
+}
@@ -24,6 +24,8 @@ type FtpService struct {
 	chroot             string
 	certificate        tls.Certificate
 	writeNotifications chan WriteNotification
+	state              *serviceState
+	quit               chan struct{}
 	server             *server.FtpServer
 	driver             *ftpDriver
 }
@@ -37,6 +39,8 @@ func NewFtpService(host string, port int, chroot string, certificate tls.Certifi
 		chroot:             chroot,
 		certificate:        certificate,
 		writeNotifications: make(chan WriteNotification, 100),
+		state:              newServiceState(),
+		quit:               make(chan struct{}),
 	}
 }
 
@@ -66,8 +70,16 @@ func (s *FtpService) Start() error {
 
 	s.server = server.NewFtpServer(s.driver)
 
+	// Listen right away so that failing to bind is not silently retried
+	if err := s.server.Listen(); err != nil {
+		s.state.set(false, err)
+		return err
+	}
+
 	go s.serve()
 
+	s.state.set(true, nil)
+
 	return nil
 }
 
@@ -79,26 +91,57 @@ func (s *FtpService) Reload(routes []Route) error {
 
 // Stop stops the server gracefully.
 func (s *FtpService) Stop() error {
+	s.state.set(false, nil)
+	close(s.quit)
+
 	return s.server.Stop()
 }
 
+// Status returns the current status of the service.
+func (s *FtpService) Status() ServiceStatus {
+	return s.state.status(s.Name())
+}
+
 // WriteNotifications returns the file write notification channel.
 func (s *FtpService) WriteNotifications() chan WriteNotification {
 	return s.writeNotifications
 }
 
+// serve serves clients until the service is stopped. If the listener closes unexpectedly,
+// it is reopened after 5 seconds and the service is reported as not running in the meantime.
 func (s *FtpService) serve() {
 	for {
-		if err := s.server.ListenAndServe(); err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Error("FTP server crashed, restarting after 5 seconds")
+		s.server.Serve()
+
+		select {
+		case <-s.quit:
+			return
+		default:
+		}
 
-			time.Sleep(5 * time.Second)
-			continue
+		s.state.set(false, errors.New("FTP listener closed unexpectedly"))
+		log.Error("FTP server crashed, restarting after 5 seconds")
+
+		for {
+			select {
+			case <-s.quit:
+				return
+			case <-time.After(5 * time.Second):
+			}
+
+			if err := s.server.Listen(); err != nil {
+				s.state.set(false, err)
+
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("Failed to restart FTP server, retrying after 5 seconds")
+				continue
+			}
+
+			break
 		}
 
-		break
+		s.state.set(true, nil)
 	}
 }
 
@@ -130,6 +173,7 @@ func (drv *ftpDriver) SetRoutes(routes []Route) {
 }
 
 func (drv *ftpDriver) WelcomeUser(cc server.ClientContext) (string, error) {
+	sessions.WithLabelValues("ftp").Inc()
 	return "Shuttle", nil
 }
 
@@ -147,6 +191,7 @@ func (drv *ftpDriver) AuthUser(cc server.ClientContext, user, pass string) (serv
 		}
 	}
 
+	authFailures.WithLabelValues("ftp").Inc()
 	return nil, errors.New("Login incorrect")
 }
 
@@ -180,7 +225,9 @@ func (drv *ftpDriver) ListFiles(cc server.ClientContext) ([]os.FileInfo, error)
 	return files, nil
 }
 
-func (drv *ftpDriver) UserLeft(cc server.ClientContext) {}
+func (drv *ftpDriver) UserLeft(cc server.ClientContext) {
+	sessions.WithLabelValues("ftp").Dec()
+}
 
 func (drv *ftpDriver) OpenFile(cc server.ClientContext, path string, flag int) (server.FileStream, error) {
 	// If we are writing and we are not in append mode, we should remove the file
@@ -230,10 +277,7 @@ func (drv *ftpDriver) GetSettings() *server.Settings {
 }
 
 func (drv *ftpDriver) NotifyWrite(cc server.ClientContext, path string) error {
-	drv.writeNotifications <- WriteNotification{
-		Username: cc.User(),
-		Path:     drv.path(cc, path),
-	}
+	drv.writeNotifications <- NewWriteNotification(cc.User(), drv.path(cc, path), ClientIP(cc.RemoteAddr().String()))
 
 	return nil
 }
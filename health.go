@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+)
+
+// HealthCheck is the result of a single check of a HealthReport.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// HealthReport is the result of a liveness or readiness check.
+type HealthReport struct {
+	Healthy bool          `json:"healthy"`
+	Checks  []HealthCheck `json:"checks"`
+}
+
+func (r *HealthReport) add(name string, err error) {
+	check := HealthCheck{
+		Name:    name,
+		Healthy: err == nil,
+	}
+
+	if err != nil {
+		check.Error = err.Error()
+		r.Healthy = false
+	}
+
+	r.Checks = append(r.Checks, check)
+}
+
+// Liveness reports whether Shuttle is making progress, i.e. whether restarting it could help.
+func (mc *MissionControl) Liveness() HealthReport {
+	report := HealthReport{Healthy: true}
+	report.add("queue", mc.Launchpad.StuckError())
+
+	return report
+}
+
+// Readiness reports whether every service is listening, the journal is writable and the queue is moving.
+func (mc *MissionControl) Readiness() HealthReport {
+	report := HealthReport{Healthy: true}
+
+	for _, service := range mc.Services {
+		status := service.Status()
+
+		check := HealthCheck{
+			Name:    "service:" + status.Name,
+			Healthy: status.Running,
+			Error:   status.Error,
+		}
+
+		if !status.Running {
+			if check.Error == "" {
+				check.Error = "Service is not running"
+			}
+
+			report.Healthy = false
+		}
+
+		report.Checks = append(report.Checks, check)
+	}
+
+	report.add("journal", mc.Launchpad.JournalError())
+	report.add("queue", mc.Launchpad.StuckError())
+
+	return report
+}
+
+// serveHealth serves the report of the check, with 503 Service Unavailable if it is not healthy.
+func serveHealth(check func() HealthReport) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "GET" && request.Method != "HEAD" {
+			writeJSONError(writer, http.StatusMethodNotAllowed, "Invalid method")
+			return
+		}
+
+		report := check()
+		if !report.Healthy {
+			writeJSON(writer, http.StatusServiceUnavailable, report)
+			return
+		}
+
+		writeJSON(writer, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Final statuses of the deliveries in the history.
+const (
+	HistoryDelivered = "delivered"
+	HistoryFailed    = "failed"
+)
+
+// HistoryEntry is a completed or failed delivery.
+type HistoryEntry struct {
+	TransferID         string    `json:"transfer_id"`
+	Username           string    `json:"username"`
+	Filename           string    `json:"filename"`
+	Size               int64     `json:"size"`
+	SHA256             string    `json:"sha256,omitempty"`
+	Endpoint           string    `json:"endpoint"`
+	Status             string    `json:"status"`
+	StatusCode         int       `json:"status_code,omitempty"`
+	Attempts           int       `json:"attempts"`
+	FailedDestinations []string  `json:"failed_destinations,omitempty"`
+	Received           time.Time `json:"received"`
+	Completed          time.Time `json:"completed"`
+	Error              string    `json:"error,omitempty"`
+}
+
+// NewHistoryEntry creates a new HistoryEntry of the shuttle that was completed right now.
+// The destinations that did not accept the file are listed even if the file was delivered,
+// since optional destinations are allowed to fail.
+func NewHistoryEntry(shuttle Shuttle, status string, statusCode int) HistoryEntry {
+	failed := []string{}
+	for _, delivery := range shuttle.Deliveries {
+		if delivery.Status == DeliveryFailed && delivery.Destination != "" {
+			failed = append(failed, delivery.Destination)
+		}
+	}
+
+	sort.Strings(failed)
+
+	return HistoryEntry{
+		TransferID:         shuttle.TransferID,
+		Username:           shuttle.Route.Username,
+		Filename:           filepath.Base(shuttle.Path),
+		Size:               shuttle.Size,
+		SHA256:             shuttle.SHA256,
+		Endpoint:           shuttle.Endpoints(),
+		Status:             status,
+		StatusCode:         statusCode,
+		Attempts:           shuttle.Attempts,
+		FailedDestinations: failed,
+		Received:           shuttle.Created,
+		Completed:          time.Now().UTC(),
+	}
+}
+
+// HistoryFilter selects entries from the history. Empty fields match every entry,
+// the time range applies to the time the file was received.
+type HistoryFilter struct {
+	Username string
+	Filename string
+	Since    time.Time
+	Until    time.Time
+}
+
+// NewHistoryFilter creates a new HistoryFilter. The times can be given either in the RFC 3339 format
+// or as dates, e.g. 2006-01-02, which are interpreted in the local time zone. Empty values match every entry.
+func NewHistoryFilter(username string, filename string, since string, until string) (HistoryFilter, error) {
+	filter := HistoryFilter{
+		Username: username,
+		Filename: filename,
+	}
+
+	var err error
+	if filter.Since, err = parseHistoryTime(since); err != nil {
+		return filter, err
+	}
+
+	if filter.Until, err = parseHistoryTime(until); err != nil {
+		return filter, err
+	}
+
+	return filter, nil
+}
+
+func parseHistoryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("Invalid time %q, expected e.g. 2006-01-02 or 2006-01-02T15:04:05Z", value)
+	}
+
+	return t, nil
+}
+
+func (f HistoryFilter) matches(entry HistoryEntry) bool {
+	if f.Username != "" && entry.Username != f.Username {
+		return false
+	}
+
+	if f.Filename != "" && entry.Filename != f.Filename {
+		return false
+	}
+
+	if !f.Since.IsZero() && entry.Received.Before(f.Since) {
+		return false
+	}
+
+	if !f.Until.IsZero() && !entry.Received.Before(f.Until) {
+		return false
+	}
+
+	return true
+}
+
+// History is the delivery history, stored as one JSON object per line.
+// Entries older than the retention are pruned by rewriting the file.
+type History struct {
+	path      string
+	retention time.Duration
+	file      *os.File
+	mutex     *sync.Mutex
+}
+
+// OpenHistory opens the history in the given path, creating it if it does not exist.
+// A retention of zero keeps the entries forever.
+func OpenHistory(path string, retention time.Duration) (*History, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	return &History{
+		path:      path,
+		retention: retention,
+		file:      file,
+		mutex:     &sync.Mutex{},
+	}, nil
+}
+
+// Add appends the entry to the history. Does nothing if the history is nil.
+func (h *History) Add(entry HistoryEntry) {
+	if h == nil {
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Failed to encode history entry")
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, err := h.file.Write(append(line, '\n')); err != nil {
+		log.WithFields(log.Fields{
+			"transfer": entry.TransferID,
+			"err":      err,
+		}).Error("Failed to write history entry")
+	}
+}
+
+// Query returns the entries that match the filter, oldest first.
+func (h *History) Query(filter HistoryFilter) ([]HistoryEntry, error) {
+	return ReadHistory(h.path, filter)
+}
+
+// Prune removes the entries that were completed before the retention.
+func (h *History) Prune() (int, error) {
+	if h.retention <= 0 {
+		return 0, nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	cutoff := time.Now().Add(-h.retention)
+	kept, pruned := []HistoryEntry{}, 0
+
+	err := scanHistory(h.path, func(entry HistoryEntry) {
+		if entry.Completed.Before(cutoff) {
+			pruned++
+			return
+		}
+
+		kept = append(kept, entry)
+	})
+
+	if err != nil || pruned == 0 {
+		return 0, err
+	}
+
+	temporaryPath := h.path + ".tmp"
+	temporary, err := os.OpenFile(temporaryPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return 0, err
+	}
+
+	writer := bufio.NewWriter(temporary)
+	encoder := json.NewEncoder(writer)
+
+	for _, entry := range kept {
+		if err := encoder.Encode(entry); err != nil {
+			temporary.Close()
+			return 0, err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		temporary.Close()
+		return 0, err
+	}
+
+	if err := temporary.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(temporaryPath, h.path); err != nil {
+		return 0, err
+	}
+
+	// Entries are appended to the new file from now on
+	file, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return 0, err
+	}
+
+	h.file.Close()
+	h.file = file
+
+	return pruned, nil
+}
+
+// PrunePeriodically calls History.Prune every interval, it never returns.
+func (h *History) PrunePeriodically(interval time.Duration) {
+	for range time.Tick(interval) {
+		pruned, err := h.Prune()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"path": h.path,
+				"err":  err,
+			}).Error("Failed to prune history")
+			continue
+		}
+
+		if pruned > 0 {
+			log.WithFields(log.Fields{
+				"count": pruned,
+			}).Info("Pruned history")
+		}
+	}
+}
+
+// Close closes the history.
+func (h *History) Close() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.file.Close()
+}
+
+// ReadHistory returns the entries of the history in the given path that match the filter, oldest first.
+// It can be used while Shuttle is running since the history is only appended to or replaced.
+func ReadHistory(path string, filter HistoryFilter) ([]HistoryEntry, error) {
+	entries := []HistoryEntry{}
+
+	err := scanHistory(path, func(entry HistoryEntry) {
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+	})
+
+	return entries, err
+}
+
+// scanHistory calls fn for every entry of the history. Lines that cannot be decoded,
+// for example a line that is being written, are skipped.
+func scanHistory(path string, fn func(entry HistoryEntry)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Skip the rest of an overly long line
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+
+			continue
+		}
+
+		if err == io.EOF {
+			// A line without a newline has not been written completely
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var entry HistoryEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			continue
+		}
+
+		fn(entry)
+	}
+}
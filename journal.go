@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// journalMagic is written to the beginning of every journal.
+// Files without it are treated as shuttles persisted by older versions, i.e. a gob encoded []Shuttle.
+const journalMagic = "SHJ1"
+
+// journalMaxRecord is a sanity limit for the size of a single record.
+const journalMaxRecord = 64 * 1024 * 1024
+
+type journalOp byte
+
+const (
+	journalAdd journalOp = iota + 1
+	journalUpdate
+	journalRemove
+)
+
+type journalRecord struct {
+	Op      journalOp
+	Shuttle Shuttle
+}
+
+// Journal is an append-only log of changes to the persisted shuttles.
+// Every record is framed with its length and a CRC-32 checksum and synced to the disk
+// before Append returns. When the journal is opened, the records are replayed
+// until the first incomplete or corrupted one, which is where a crash would have left off.
+// Journal is not safe for concurrent use, Launchpad serializes access to it.
+type Journal struct {
+	path    string
+	file    *os.File
+	lock    *os.File
+	offset  int64
+	records int
+}
+
+// ErrJournalLocked is returned by OpenJournal when another process has the journal open.
+var ErrJournalLocked = errors.New("Journal is in use by another process")
+
+// OpenJournal opens the journal at the path, creating it if it does not exist,
+// and returns the shuttles that the journal contains. The journal is locked using
+// a lock file next to it until it is closed. If wait is false and the journal
+// is already locked, ErrJournalLocked is returned instead of waiting for the lock.
+func OpenJournal(path string, wait bool) (*Journal, map[string]Shuttle, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, make(map[string]Shuttle), err
+	}
+
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+
+	if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+		lock.Close()
+
+		if err == syscall.EWOULDBLOCK {
+			return nil, make(map[string]Shuttle), ErrJournalLocked
+		}
+
+		return nil, make(map[string]Shuttle), err
+	}
+
+	journal, shuttles, err := openJournal(path)
+	if err != nil {
+		lock.Close()
+		return nil, shuttles, err
+	}
+
+	journal.lock = lock
+	return journal, shuttles, nil
+}
+
+func openJournal(path string) (*Journal, map[string]Shuttle, error) {
+	shuttles := make(map[string]Shuttle)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, shuttles, err
+	}
+
+	journal := &Journal{
+		path: path,
+		file: file,
+	}
+
+	magic := make([]byte, len(journalMagic))
+	n, err := io.ReadFull(file, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		file.Close()
+		return nil, shuttles, err
+	}
+
+	// An empty file or a header that was cut off while the journal was being created
+	if n < len(journalMagic) && string(magic[:n]) == journalMagic[:n] {
+		return journal, shuttles, journal.Compact(shuttles)
+	}
+
+	if string(magic[:n]) != journalMagic {
+		legacy, err := journal.readLegacy()
+		if err != nil {
+			file.Close()
+
+			// Nothing can be recovered from it but keep it around for investigation
+			log.WithFields(log.Fields{
+				"path": path,
+				"err":  err,
+			}).Warning("Persisted shuttles are corrupted, starting with an empty journal")
+
+			if err := os.Rename(path, path+".corrupt"); err != nil {
+				return nil, shuttles, err
+			}
+
+			return openJournal(path)
+		}
+
+		for _, shuttle := range legacy {
+			shuttles[shuttle.Path] = shuttle
+		}
+
+		// Convert the file into a journal right away
+		return journal, shuttles, journal.Compact(shuttles)
+	}
+
+	journal.offset = int64(len(journalMagic))
+	if err := journal.replay(shuttles); err != nil {
+		file.Close()
+		return nil, shuttles, err
+	}
+
+	return journal, shuttles, nil
+}
+
+// Records returns the amount of records written since the journal was last compacted.
+func (j *Journal) Records() int {
+	return j.records
+}
+
+// Append writes a record to the end of the journal and syncs it to the disk.
+func (j *Journal) Append(op journalOp, shuttle Shuttle) error {
+	if err := j.write(op, shuttle); err != nil {
+		return err
+	}
+
+	return j.file.Sync()
+}
+
+func (j *Journal) write(op journalOp, shuttle Shuttle) error {
+	payload := &bytes.Buffer{}
+	if err := gob.NewEncoder(payload).Encode(journalRecord{Op: op, Shuttle: shuttle}); err != nil {
+		return err
+	}
+
+	frame := make([]byte, 8, 8+payload.Len())
+	binary.BigEndian.PutUint32(frame[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	frame = append(frame, payload.Bytes()...)
+
+	if _, err := j.file.WriteAt(frame, j.offset); err != nil {
+		// Do not leave a partial record behind, it would hide the records appended after it
+		j.file.Truncate(j.offset)
+		return err
+	}
+
+	j.offset += int64(len(frame))
+	j.records++
+
+	return nil
+}
+
+// Compact replaces the journal with one that only contains the given shuttles.
+// The new journal is written next to the old one and renamed over it once it has been synced.
+func (j *Journal) Compact(shuttles map[string]Shuttle) error {
+	temporary := j.path + ".tmp"
+
+	file, err := os.OpenFile(temporary, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	compacted := &Journal{
+		path: j.path,
+		file: file,
+	}
+
+	if _, err := file.Write([]byte(journalMagic)); err != nil {
+		file.Close()
+		return err
+	}
+
+	compacted.offset = int64(len(journalMagic))
+
+	for _, shuttle := range shuttles {
+		if err := compacted.write(journalAdd, shuttle); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := os.Rename(temporary, j.path); err != nil {
+		file.Close()
+		return err
+	}
+
+	// Make sure that the rename itself survives a crash
+	if directory, err := os.Open(filepath.Dir(j.path)); err == nil {
+		directory.Sync()
+		directory.Close()
+	}
+
+	j.file.Close()
+	j.file = file
+	j.offset = compacted.offset
+	j.records = compacted.records
+
+	return nil
+}
+
+// Close closes the journal and releases the lock.
+func (j *Journal) Close() error {
+	err := j.file.Close()
+
+	if j.lock != nil {
+		j.lock.Close()
+	}
+
+	return err
+}
+
+func (j *Journal) replay(shuttles map[string]Shuttle) error {
+	reader := bufio.NewReader(io.NewSectionReader(j.file, j.offset, 1<<62))
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return j.truncate(err)
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if length > journalMaxRecord {
+			return j.truncate(errors.New("record too large"))
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return j.truncate(err)
+		}
+
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return j.truncate(errors.New("checksum mismatch"))
+		}
+
+		var record journalRecord
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&record); err != nil {
+			return j.truncate(err)
+		}
+
+		switch record.Op {
+		case journalAdd, journalUpdate:
+			shuttles[record.Shuttle.Path] = record.Shuttle
+		case journalRemove:
+			delete(shuttles, record.Shuttle.Path)
+		}
+
+		j.offset += int64(len(header)) + int64(length)
+		j.records++
+	}
+}
+
+// truncate cuts off a corrupted tail of the journal so that new records are appended after the last valid one.
+func (j *Journal) truncate(cause error) error {
+	info, err := j.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"path":      j.path,
+		"err":       cause,
+		"discarded": info.Size() - j.offset,
+	}).Warning("Journal has a corrupted tail, discarding it")
+
+	if err := j.file.Truncate(j.offset); err != nil {
+		return err
+	}
+
+	return j.file.Sync()
+}
+
+func (j *Journal) readLegacy() ([]Shuttle, error) {
+	shuttles := []Shuttle{}
+
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return shuttles, err
+	}
+
+	if err := gob.NewDecoder(j.file).Decode(&shuttles); err != nil {
+		return shuttles, err
+	}
+
+	return shuttles, nil
+}
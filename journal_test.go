@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestJournal opens a journal in a new temporary directory, returns the path of the journal.
+func openTestJournal(t *testing.T) (*Journal, string) {
+	directory, err := ioutil.TempDir("", "shuttle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(directory, "shuttles.gob")
+
+	journal, shuttles, err := OpenJournal(path, false)
+	if err != nil {
+		os.RemoveAll(directory)
+		t.Fatal(err)
+	}
+
+	if len(shuttles) != 0 {
+		t.Errorf("Expected a new journal to be empty, got %d shuttles", len(shuttles))
+	}
+
+	return journal, path
+}
+
+func appendShuttles(t *testing.T, journal *Journal, paths ...string) {
+	for _, path := range paths {
+		if err := journal.Append(journalAdd, Shuttle{Path: path, TransferID: "transfer-" + path}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func reopenJournal(t *testing.T, journal *Journal, path string) (*Journal, map[string]Shuttle) {
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, shuttles, err := OpenJournal(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return journal, shuttles
+}
+
+func expectShuttles(t *testing.T, shuttles map[string]Shuttle, paths ...string) {
+	if len(shuttles) != len(paths) {
+		t.Errorf("Expected %d shuttles, got %d: %v", len(paths), len(shuttles), shuttles)
+	}
+
+	for _, path := range paths {
+		shuttle, found := shuttles[path]
+		if !found {
+			t.Errorf("Shuttle %s was not replayed", path)
+			continue
+		}
+
+		if shuttle.TransferID != "transfer-"+path {
+			t.Errorf("Shuttle %s has transfer ID %q", path, shuttle.TransferID)
+		}
+	}
+}
+
+func TestJournalReplaysRecords(t *testing.T) {
+	journal, path := openTestJournal(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	appendShuttles(t, journal, "a", "b", "c")
+
+	updated := Shuttle{Path: "b", TransferID: "transfer-b", Attempts: 3}
+	if err := journal.Append(journalUpdate, updated); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := journal.Append(journalRemove, Shuttle{Path: "c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, shuttles := reopenJournal(t, journal, path)
+	defer journal.Close()
+
+	expectShuttles(t, shuttles, "a", "b")
+
+	if shuttles["b"].Attempts != 3 {
+		t.Errorf("Expected the update to be replayed, shuttle has %d attempts", shuttles["b"].Attempts)
+	}
+
+	if journal.Records() != 5 {
+		t.Errorf("Expected 5 records, got %d", journal.Records())
+	}
+}
+
+func TestJournalDiscardsTruncatedTail(t *testing.T) {
+	journal, path := openTestJournal(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	appendShuttles(t, journal, "a", "b")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appendShuttles(t, journal, "c")
+
+	// Cut the last record in half as if the process crashed while writing it
+	end, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Truncate(path, info.Size()+(end.Size()-info.Size())/2); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, shuttles := reopenJournal(t, journal, path)
+	expectShuttles(t, shuttles, "a", "b")
+
+	if truncated, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if truncated.Size() != info.Size() {
+		t.Errorf("Expected the journal to be cut to %d bytes, it has %d", info.Size(), truncated.Size())
+	}
+
+	// New records are appended after the last valid one
+	appendShuttles(t, journal, "d")
+
+	journal, shuttles = reopenJournal(t, journal, path)
+	defer journal.Close()
+
+	expectShuttles(t, shuttles, "a", "b", "d")
+}
+
+func TestJournalDiscardsCorruptedTail(t *testing.T) {
+	journal, path := openTestJournal(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	appendShuttles(t, journal, "a", "b", "c")
+
+	// Flip the last byte of the last record so that its checksum no longer matches
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content[len(content)-1] ^= 0xff
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, shuttles := reopenJournal(t, journal, path)
+	expectShuttles(t, shuttles, "a", "b")
+
+	appendShuttles(t, journal, "d")
+
+	journal, shuttles = reopenJournal(t, journal, path)
+	defer journal.Close()
+
+	expectShuttles(t, shuttles, "a", "b", "d")
+}
+
+func TestJournalCompact(t *testing.T) {
+	journal, path := openTestJournal(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	appendShuttles(t, journal, "a", "b", "c")
+
+	if err := journal.Compact(map[string]Shuttle{"a": {Path: "a", TransferID: "transfer-a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if journal.Records() != 1 {
+		t.Errorf("Expected a single record after compacting, got %d", journal.Records())
+	}
+
+	appendShuttles(t, journal, "d")
+
+	journal, shuttles := reopenJournal(t, journal, path)
+	defer journal.Close()
+
+	expectShuttles(t, shuttles, "a", "d")
+}
+
+func TestJournalIsLocked(t *testing.T) {
+	journal, path := openTestJournal(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer journal.Close()
+
+	if _, _, err := OpenJournal(path, false); err != ErrJournalLocked {
+		t.Fatalf("Expected the journal to be locked, got %v", err)
+	}
+}
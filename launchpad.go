@@ -1,174 +1,799 @@
 package main
 
 import (
-	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// journalCompactMin is the amount of records the journal can grow to before it is compacted.
+// After that the journal is compacted whenever it has twice as many records as there are shuttles.
+const journalCompactMin = 1024
+
+// Launchpad keeps track of the shuttles and sends them on their way.
+// New and restored shuttles go through the Schedule, which moves them to the Dispatcher once they are due,
+// so adding a shuttle never blocks on the workers.
 type Launchpad struct {
-	Queue         chan Shuttle
+	Dispatcher    *Dispatcher
+	Schedule      *Schedule
 	Retry         int
+	RetryMax      int
+	StuckAfter    int
 	Enroute       *sync.WaitGroup
 	ShuttlesPath  string
-	Shuttles      []Shuttle
+	Shuttles      map[string]Shuttle
+	InFlight      map[string]time.Time
 	ShuttlesMutex *sync.Mutex
+	Journal       *Journal
+	History       *History
+	Breakers      *CircuitBreakers
+
+	// Guarded by ShuttlesMutex as well
+	lines        map[string]*Line
+	journalErr   error
+	lastProgress time.Time
 }
 
-func NewLaunchpad(retry int, shuttlesPath string) Launchpad {
+func NewLaunchpad(retry int, retryMax int, stuckAfter int, breakerFailures int, breakerCooldown int, shuttlesPath string) Launchpad {
 	return Launchpad{
-		Queue:         make(chan Shuttle, 100),
+		Dispatcher:    NewDispatcher(),
+		Schedule:      NewSchedule(),
 		Retry:         retry,
+		RetryMax:      retryMax,
+		StuckAfter:    stuckAfter,
 		Enroute:       &sync.WaitGroup{},
 		ShuttlesPath:  shuttlesPath,
-		Shuttles:      []Shuttle{},
+		Shuttles:      make(map[string]Shuttle),
+		InFlight:      make(map[string]time.Time),
 		ShuttlesMutex: &sync.Mutex{},
+		Breakers:      NewCircuitBreakers(breakerFailures, time.Duration(breakerCooldown)*time.Second),
+		lines:         make(map[string]*Line),
+		lastProgress:  time.Now(),
 	}
 }
 
+// LoadShuttles opens the journal and schedules the shuttles persisted in it.
+// It must be called before any shuttles are added, otherwise they are not persisted.
 func (lp *Launchpad) LoadShuttles() (int, error) {
-	shuttles := []Shuttle{}
+	journal, shuttles, err := OpenJournal(lp.ShuttlesPath, false)
+	if err == ErrJournalLocked {
+		// Most likely an administrative command that is about to finish
+		log.WithFields(log.Fields{
+			"path": lp.ShuttlesPath,
+		}).Warning("Journal is locked by another process, waiting for it")
+
+		journal, shuttles, err = OpenJournal(lp.ShuttlesPath, true)
+	}
 
-	file, err := os.Open(lp.ShuttlesPath)
 	if err != nil {
 		return 0, err
 	}
 
-	defer file.Close()
+	restored := []Shuttle{}
+	for _, shuttle := range shuttles {
+		// Shuttles persisted by older versions have no creation time or transfer ID
+		if shuttle.Created.IsZero() {
+			shuttle.Created = time.Now()
+		}
 
-	decoder := gob.NewDecoder(file)
-	if err := decoder.Decode(&shuttles); err != nil {
-		return 0, err
+		if shuttle.TransferID == "" {
+			shuttle.TransferID = NewTransferID()
+		}
+
+		// Older versions kept the retry state of their single endpoint in the shuttle itself
+		if len(shuttle.Deliveries) == 0 && shuttle.Attempts > 0 && len(shuttle.Route.Destinations) == 0 {
+			shuttle.Deliveries = []Delivery{{
+				Status:      DeliveryPending,
+				Attempts:    shuttle.Attempts,
+				NextAttempt: shuttle.NextAttempt,
+				LastError:   shuttle.LastError,
+			}}
+		}
+
+		restored = append(restored, shuttle)
 	}
 
-	for _, shuttle := range shuttles {
-		lp.AddShuttle(shuttle)
+	sort.Slice(restored, func(i, j int) bool {
+		return restored[i].Created.Before(restored[j].Created)
+	})
+
+	lp.ShuttlesMutex.Lock()
+	defer lp.ShuttlesMutex.Unlock()
+
+	lp.Journal = journal
+
+	for _, shuttle := range restored {
+		lp.Shuttles[shuttle.Path] = shuttle
+		lp.schedule(shuttle)
+	}
+
+	// Shuttles added before the journal was opened
+	lp.compactJournal()
+
+	return len(restored), nil
+}
+
+// Close closes the journal.
+func (lp *Launchpad) Close() error {
+	lp.ShuttlesMutex.Lock()
+	defer lp.ShuttlesMutex.Unlock()
+
+	if lp.Journal == nil {
+		return nil
 	}
 
-	return len(shuttles), nil
+	return lp.Journal.Close()
 }
 
 // Unexported since it relies on Launchpad.ShuttlesMutex being locked
-func (lp *Launchpad) writeShuttles() error {
-	file, err := os.Create(lp.ShuttlesPath)
-	if err != nil {
-		return err
+func (lp *Launchpad) writeShuttle(op journalOp, shuttle Shuttle) {
+	if lp.Journal == nil {
+		log.WithFields(log.Fields{
+			"path": shuttle.Path,
+		}).Error("Journal is not open, shuttle is not persisted")
+		return
 	}
 
-	defer file.Close()
+	if err := lp.Journal.Append(op, shuttle); err != nil {
+		lp.journalErr = err
 
-	encoder := gob.NewEncoder(file)
-	encoder.Encode(lp.Shuttles)
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Failed to write shuttles, lets hope we don't crash...")
+		return
+	}
 
-	return nil
+	lp.journalErr = nil
+
+	if lp.Journal.Records() > journalCompactMin && lp.Journal.Records() > 2*len(lp.Shuttles) {
+		lp.compactJournal()
+	}
 }
 
-func (lp *Launchpad) HasShuttle(shuttle Shuttle) bool {
-	lp.ShuttlesMutex.Lock()
-	defer lp.ShuttlesMutex.Unlock()
+// Unexported since it relies on Launchpad.ShuttlesMutex being locked
+func (lp *Launchpad) compactJournal() {
+	if err := lp.Journal.Compact(lp.Shuttles); err != nil {
+		lp.journalErr = err
 
-	found := false
-	for _, otherShuttle := range lp.Shuttles {
-		if shuttle.Path == otherShuttle.Path {
-			found = true
-			break
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Failed to compact journal")
+	}
+}
+
+// Unexported since it relies on Launchpad.ShuttlesMutex being locked
+func (lp *Launchpad) schedule(shuttle Shuttle) {
+	// The shuttles of an ordered route wait in line until they are at its head
+	if shuttle.Route.Ordered {
+		line, found := lp.lines[shuttle.Route.Username]
+		if !found {
+			line = NewLine(shuttle.Route.OrderBy)
+			lp.lines[shuttle.Route.Username] = line
+		}
+
+		if !line.Add(shuttle) {
+			return
 		}
 	}
 
+	// Restored shuttles might still be waiting for a retry
+	at := time.Now()
+	if shuttle.NextAttempt.After(at) {
+		at = shuttle.NextAttempt
+	}
+
+	lp.Schedule.Add(shuttle, at)
+}
+
+// release takes the shuttle out of the line of its ordered route if it is done, and schedules
+// the head of the line in case it changed or was turned away while the shuttle was enroute.
+// Unexported since it relies on Launchpad.ShuttlesMutex being locked
+func (lp *Launchpad) release(shuttle Shuttle, done bool) {
+	line, found := lp.lines[shuttle.Route.Username]
+	if !found {
+		return
+	}
+
+	line.Release(shuttle.Path)
+	if done {
+		line.Remove(shuttle.Path)
+	}
+
+	head, found := line.Head()
+	if !found {
+		delete(lp.lines, shuttle.Route.Username)
+		return
+	}
+
+	if head == shuttle.Path {
+		return
+	}
+
+	next := lp.Shuttles[head]
+
+	at := time.Now()
+	if next.NextAttempt.After(at) {
+		at = next.NextAttempt
+	}
+
+	lp.Schedule.Add(next, at)
+}
+
+func (lp *Launchpad) HasShuttle(shuttle Shuttle) bool {
+	lp.ShuttlesMutex.Lock()
+	defer lp.ShuttlesMutex.Unlock()
+
+	_, found := lp.Shuttles[shuttle.Path]
 	return found
 }
 
 func (lp *Launchpad) AddShuttle(shuttle Shuttle) {
-	if lp.HasShuttle(shuttle) {
+	lp.ShuttlesMutex.Lock()
+	defer lp.ShuttlesMutex.Unlock()
+
+	if _, found := lp.Shuttles[shuttle.Path]; found {
 		return
 	}
 
+	lp.Shuttles[shuttle.Path] = shuttle
+	lp.writeShuttle(journalAdd, shuttle)
+	lp.schedule(shuttle)
+
+	auditLog.Record(NewAuditEvent(AuditQueued, shuttle))
+}
+
+// RescheduleShuttle persists the new state of an enroute shuttle and schedules its next attempt.
+func (lp *Launchpad) RescheduleShuttle(shuttle Shuttle) {
 	lp.ShuttlesMutex.Lock()
 	defer lp.ShuttlesMutex.Unlock()
 
-	lp.Shuttles = append(lp.Shuttles, shuttle)
-	if err := lp.writeShuttles(); err != nil {
-		log.WithFields(log.Fields{
-			"err": err,
-		}).Error("Failed to write shuttles, lets hope we don't crash...")
+	// Not enroute anymore, otherwise the shuttle could be discarded if it is due right away
+	delete(lp.InFlight, shuttle.Path)
+	lp.lastProgress = time.Now()
+
+	if _, found := lp.Shuttles[shuttle.Path]; !found {
+		return
 	}
 
-	lp.Queue <- shuttle
+	lp.Shuttles[shuttle.Path] = shuttle
+	lp.writeShuttle(journalUpdate, shuttle)
+	lp.Schedule.Add(shuttle, shuttle.NextAttempt)
+	lp.release(shuttle, false)
 }
 
 func (lp *Launchpad) RemoveShuttle(shuttle Shuttle) {
 	lp.ShuttlesMutex.Lock()
 	defer lp.ShuttlesMutex.Unlock()
 
-	shuttles := []Shuttle{}
-	for _, otherShuttle := range lp.Shuttles {
-		if shuttle.Path != otherShuttle.Path {
-			shuttles = append(shuttles, otherShuttle)
-		}
-	}
+	delete(lp.InFlight, shuttle.Path)
+	lp.lastProgress = time.Now()
 
-	lp.Shuttles = shuttles
-	if err := lp.writeShuttles(); err != nil {
-		log.WithFields(log.Fields{
-			"err": err,
-		}).Error("Failed to write shuttles, lets hope we don't crash...")
+	if _, found := lp.Shuttles[shuttle.Path]; !found {
+		return
 	}
+
+	delete(lp.Shuttles, shuttle.Path)
+	lp.writeShuttle(journalRemove, Shuttle{Path: shuttle.Path})
+	lp.release(shuttle, true)
 }
 
 func (lp *Launchpad) LaunchShuttles() {
-	for shuttle := range lp.Queue {
-		if !lp.HasShuttle(shuttle) {
-			// Discard the shuttle from queue
-			continue
+	for {
+		queued := lp.Dispatcher.Pop()
+
+		// Shuttles that are not claimed are discarded from the queue
+		if shuttle, ok := lp.claim(queued); ok {
+			// Launching always ends up removing or rescheduling the shuttle, which also releases it
+			lp.launch(shuttle)
 		}
 
-		logger := log.WithFields(log.Fields{
-			"path":     shuttle.Path,
-			"endpoint": shuttle.Route.Endpoint,
-		})
+		lp.Dispatcher.Done(queued)
+	}
+}
+
+func (lp *Launchpad) launch(shuttle Shuttle) {
+	logger := log.WithFields(log.Fields{
+		"transfer": shuttle.TransferID,
+		"path":     shuttle.Path,
+		"endpoint": shuttle.Endpoints(),
+	})
+
+	// A delivered shuttle is only waiting for its payload to be archived or removed, which might have happened already
+	if _, err := os.Stat(shuttle.Path); os.IsNotExist(err) && shuttle.Cleanups == 0 {
+		logger.Warning("Shuttle payload has gone missing, discarding")
+
+		event := NewAuditEvent(AuditDiscarded, shuttle)
+		event.Error = "Payload has gone missing"
+		auditLog.Record(event)
+
+		entry := NewHistoryEntry(shuttle, HistoryFailed, 0)
+		entry.Error = event.Error
+		lp.History.Add(entry)
+
+		lp.RemoveShuttle(shuttle)
+		return
+	}
+
+	lp.Enroute.Add(1)
+	defer lp.Enroute.Done()
 
-		if _, err := os.Stat(shuttle.Path); os.IsNotExist(err) {
-			logger.Warning("Shuttle payload has gone missing, discarding")
+	// Every destination that is due is attempted, unless a required one rejects the file
+	var response ResponseExcerpt
+	var failure string
+	now := time.Now()
+
+	for _, destination := range shuttle.Route.Targets() {
+		delivery := shuttle.Delivery(destination.Name)
+		if delivery.Status != DeliveryPending || delivery.NextAttempt.After(now) {
 			continue
 		}
 
-		lp.Enroute.Add(1)
+		shuttle, response = lp.deliver(shuttle, destination)
 
-		logger.Info("Shuttle received, transporting to destination")
+		delivery = shuttle.Delivery(destination.Name)
+		if delivery.Status == DeliveryFailed && !destination.Optional {
+			failure = delivery.LastError
+			if destination.Name != "" {
+				failure = destination.Name + ": " + failure
+			}
 
-		if err := shuttle.Send(); err != nil {
-			// This should always succeed
-			transportErr := err.(TransportError)
-			cause := transportErr.Cause
+			break
+		}
+	}
 
-			if transportErr.Temporary {
-				logger.WithFields(log.Fields{
-					"err":   cause,
-					"delay": lp.Retry,
-				}).Error("Shuttle crashed, retrying soon")
+	if failure != "" {
+		logger.WithFields(log.Fields{
+			"err": failure,
+		}).Error("Shuttle was not accepted by every required destination, moving to failed folder")
 
-				go func(queue chan Shuttle, retry int, shuttle Shuttle) {
-					time.Sleep(time.Duration(retry) * time.Second)
-					queue <- shuttle
-				}(lp.Queue, lp.Retry, shuttle)
-			} else {
-				logger.WithFields(log.Fields{
-					"err": cause,
-				}).Error("Shuttle crashed with a non-temporary error, discarding")
+		if err := shuttle.Fail(failure, response); err != nil {
+			logger.WithFields(log.Fields{
+				"err": err,
+			}).Error("Failed to move shuttle payload to failed folder")
+		}
 
-				lp.RemoveShuttle(shuttle)
-			}
+		entry := NewHistoryEntry(shuttle, HistoryFailed, response.StatusCode)
+		entry.Error = failure
+		lp.History.Add(entry)
+
+		lp.RemoveShuttle(shuttle)
+		return
+	}
+
+	// Some destinations are waiting for a retry
+	if next, pending := shuttle.Pending(); pending {
+		shuttle.NextAttempt = next
+		lp.RescheduleShuttle(shuttle)
+		return
+	}
+
+	// The payload can be gone already if archiving or removing it failed halfway through on an earlier try
+	var archive string
+	var err error
+	if _, statErr := os.Stat(shuttle.Path); shuttle.Cleanups == 0 || !os.IsNotExist(statErr) {
+		archive, err = shuttle.Complete()
+	}
+
+	if err != nil {
+		// Keep the shuttle so that the file is not sent again by a rescan, only archiving or removing it is retried
+		shuttle.Cleanups++
+		shuttle.LastError = err.Error()
+		shuttle.NextAttempt = time.Now().Add(lp.backoff(shuttle.Cleanups))
+
+		logger.WithFields(log.Fields{
+			"err":      err,
+			"attempts": shuttle.Cleanups,
+		}).Error("Shuttle was delivered but its payload could not be archived or removed, retrying soon")
+
+		lp.RescheduleShuttle(shuttle)
+		return
+	}
+
+	deliveryLatency.WithLabelValues(shuttle.Route.Username).Observe(time.Since(shuttle.Created).Seconds())
+
+	event := NewAuditEvent(AuditCompleted, shuttle)
+	event.Archive = archive
+	auditLog.Record(event)
+
+	lp.History.Add(NewHistoryEntry(shuttle, HistoryDelivered, response.StatusCode))
+
+	lp.RemoveShuttle(shuttle)
+	logger.Info("Shuttle arrived at the destination successfully")
+}
+
+// deliver sends the shuttle to a single destination and updates the delivery state of the destination.
+// Returns the updated shuttle and an excerpt of the response of the destination, if it responded.
+func (lp *Launchpad) deliver(shuttle Shuttle, destination Destination) (Shuttle, ResponseExcerpt) {
+	// The file is sent to the endpoint that the destination has failed over to, if any
+	target := destination
+	target.Endpoint = destination.SelectEndpoint()
+
+	fields := log.Fields{
+		"transfer": shuttle.TransferID,
+		"path":     shuttle.Path,
+		"endpoint": redactURL(target.Endpoint),
+	}
+
+	if destination.Name != "" {
+		fields["destination"] = destination.Name
+	}
+
+	logger := log.WithFields(fields)
+	delivery := shuttle.Delivery(destination.Name)
+
+	// Throttled deliveries are parked without an attempt until the time reserved for them.
+	// The rate limit goes first so that a shuttle let through as the probe of a half-open circuit is always sent
+	if !delivery.Reserved {
+		if reserved := target.RateLimit.Reserve(target.Endpoint); !reserved.IsZero() {
+			logger.Debug("Endpoint is rate limited, parking shuttle")
+			throttled.WithLabelValues(endpointLabel(target.Endpoint)).Inc()
+
+			delivery.NextAttempt = reserved
+			delivery.Reserved = true
+			shuttle.SetDelivery(delivery)
+
+			return shuttle, ResponseExcerpt{}
+		}
+	}
+
+	// Park the delivery without an attempt while the endpoint is known to be down,
+	// which still counts towards failing over to the next endpoint of the destination.
+	// The reservation of the rate limit is kept for when the delivery is tried again
+	if allowed, retryAt := lp.Breakers.Allow(target.Endpoint); !allowed {
+		logger.Debug("Circuit of the endpoint is open, parking shuttle")
+		destination.ReportEndpoint(target.Endpoint, true)
+
+		delivery.NextAttempt = retryAt
+		delivery.Reserved = true
+		shuttle.SetDelivery(delivery)
+
+		return shuttle, ResponseExcerpt{}
+	}
+
+	delivery.Reserved = false
+	delivery.Endpoint = redactURL(target.Endpoint)
+
+	logger.Info("Shuttle received, transporting to destination")
+
+	launched := time.Now()
+	username := shuttle.Route.Username
+
+	event := NewDeliveryAuditEvent(AuditAttempted, shuttle, target)
+	event.Attempt = delivery.Attempts + 1
+	auditLog.Record(event)
+
+	response, err := shuttle.Send(target)
+
+	// Errors of Send are always transport errors
+	transportErr, _ := err.(TransportError)
+	destination.ReportEndpoint(target.Endpoint, err != nil && transportErr.Temporary)
+	lp.Breakers.Report(target.Endpoint, err != nil && transportErr.Temporary)
+
+	shuttle.Attempts++
+	delivery.Attempts++
+	delivery.StatusCode = response.StatusCode
+
+	if err == nil {
+		attemptDuration.WithLabelValues(username, "success").Observe(time.Since(launched).Seconds())
+
+		delivery.Status = DeliveryDelivered
+		delivery.LastError = ""
+		shuttle.SetDelivery(delivery)
+
+		event := NewDeliveryAuditEvent(AuditDelivered, shuttle, target)
+		event.Attempt = delivery.Attempts
+		event.StatusCode = response.StatusCode
+		auditLog.Record(event)
+
+		return shuttle, response
+	}
+
+	cause := transportErr.Cause
+
+	shuttle.LastError = cause.Error()
+	delivery.LastError = cause.Error()
+
+	logger = logger.WithFields(log.Fields{
+		"err":      cause,
+		"attempts": delivery.Attempts,
+		"status":   response.StatusCode,
+		"response": response.Body,
+	})
+
+	var reason string
+	if !transportErr.Temporary {
+		reason = cause.Error()
+		logger.Error("Shuttle was rejected by the destination")
+	} else if exhausted := lp.exhausted(shuttle, destination, delivery); exhausted != "" {
+		reason = fmt.Sprintf("%s, last error: %v", exhausted, cause)
+		logger.Error("Shuttle crashed and ran out of retries")
+	}
+
+	if reason != "" {
+		attemptDuration.WithLabelValues(username, "failed").Observe(time.Since(launched).Seconds())
+
+		delivery.Status = DeliveryFailed
+		delivery.LastError = reason
+		shuttle.SetDelivery(delivery)
+
+		event := NewDeliveryAuditEvent(AuditRejected, shuttle, target)
+		event.Attempt = delivery.Attempts
+		event.Error = reason
+		event.SetResponse(response)
+		auditLog.Record(event)
+
+		return shuttle, response
+	}
+
+	// Honour the delay requested by the endpoint if it is longer than ours
+	delay := lp.backoff(delivery.Attempts)
+	if retryAfter := lp.retryAfter(shuttle, destination, transportErr.RetryAfter); retryAfter > delay {
+		delay = retryAfter
+	}
+
+	logger.WithFields(log.Fields{
+		"delay": delay,
+	}).Error("Shuttle crashed, retrying soon")
+
+	attemptDuration.WithLabelValues(username, "retry").Observe(time.Since(launched).Seconds())
+	retries.WithLabelValues(username).Inc()
+
+	delivery.NextAttempt = time.Now().Add(delay)
+	shuttle.SetDelivery(delivery)
+
+	event = NewDeliveryAuditEvent(AuditRetrying, shuttle, target)
+	event.Attempt = delivery.Attempts
+	event.Error = cause.Error()
+	event.SetResponse(response)
+	auditLog.Record(event)
+
+	return shuttle, response
+}
+
+// claim marks the shuttle as enroute and returns its current state.
+// Returns false if the shuttle has been removed, is already enroute or has been rescheduled
+// since it was queued, in which case the queued shuttle is stale and should be discarded.
+func (lp *Launchpad) claim(shuttle Shuttle) (Shuttle, bool) {
+	lp.ShuttlesMutex.Lock()
+	defer lp.ShuttlesMutex.Unlock()
+
+	current, found := lp.Shuttles[shuttle.Path]
+	if !found || !current.NextAttempt.Equal(shuttle.NextAttempt) {
+		return shuttle, false
+	}
+
+	if _, enroute := lp.InFlight[shuttle.Path]; enroute {
+		return shuttle, false
+	}
+
+	// The shuttles of an ordered route are launched one at a time from the head of the line,
+	// the rest are scheduled again once the shuttles before them are done
+	if line, found := lp.lines[current.Route.Username]; found && current.Route.Ordered && !line.Claim(current.Path) {
+		return shuttle, false
+	}
+
+	lp.InFlight[shuttle.Path] = time.Now()
+	lp.lastProgress = time.Now()
+
+	return current, true
+}
+
+// RetryShuttle schedules the shuttle to be sent right away instead of waiting for its next attempt.
+func (lp *Launchpad) RetryShuttle(path string) error {
+	lp.ShuttlesMutex.Lock()
+	defer lp.ShuttlesMutex.Unlock()
+
+	shuttle, found := lp.Shuttles[path]
+	if !found {
+		return ErrShuttleNotFound
+	}
+
+	if _, enroute := lp.InFlight[path]; enroute {
+		return ErrShuttleEnroute
+	}
+
+	// Changing the next attempt makes the previously scheduled entry stale
+	shuttle.RetryAt(time.Now())
+	lp.Shuttles[path] = shuttle
+	lp.writeShuttle(journalUpdate, shuttle)
+	lp.Schedule.Add(shuttle, shuttle.NextAttempt)
+
+	return nil
+}
+
+// CancelShuttle removes the shuttle from the queue and moves its file to the failed folder.
+func (lp *Launchpad) CancelShuttle(path string, reason string) error {
+	lp.ShuttlesMutex.Lock()
+	defer lp.ShuttlesMutex.Unlock()
+
+	shuttle, found := lp.Shuttles[path]
+	if !found {
+		return ErrShuttleNotFound
+	}
+
+	if _, enroute := lp.InFlight[path]; enroute {
+		return ErrShuttleEnroute
+	}
+
+	if err := shuttle.Fail(reason, ResponseExcerpt{}); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	entry := NewHistoryEntry(shuttle, HistoryFailed, 0)
+	entry.Error = reason
+	lp.History.Add(entry)
+
+	delete(lp.Shuttles, path)
+	lp.writeShuttle(journalRemove, Shuttle{Path: path})
+	lp.release(shuttle, true)
+
+	return nil
+}
 
-			lp.Enroute.Done()
+// Counts returns the amount of shuttles waiting to be sent and the amount of enroute shuttles.
+func (lp *Launchpad) Counts() (int, int) {
+	lp.ShuttlesMutex.Lock()
+	defer lp.ShuttlesMutex.Unlock()
+
+	return len(lp.Shuttles) - len(lp.InFlight), len(lp.InFlight)
+}
+
+// JournalError returns an error if the journal is not open or the last write to it failed.
+func (lp *Launchpad) JournalError() error {
+	lp.ShuttlesMutex.Lock()
+	defer lp.ShuttlesMutex.Unlock()
+
+	if lp.Journal == nil {
+		return errors.New("Journal is not open")
+	}
+
+	return lp.journalErr
+}
+
+// StuckError returns an error if a shuttle has been waiting to be sent for longer than
+// Launchpad.StuckAfter seconds while no shuttle has been launched or returned in that time.
+// Shuttles waiting for a retry are not considered to be waiting until their next attempt is due.
+func (lp *Launchpad) StuckError() error {
+	if lp.StuckAfter <= 0 {
+		return nil
+	}
+
+	lp.ShuttlesMutex.Lock()
+	defer lp.ShuttlesMutex.Unlock()
+
+	now := time.Now()
+	limit := time.Duration(lp.StuckAfter) * time.Second
+
+	if now.Sub(lp.lastProgress) < limit {
+		return nil
+	}
+
+	for path, shuttle := range lp.Shuttles {
+		if _, enroute := lp.InFlight[path]; enroute {
 			continue
 		}
 
-		lp.RemoveShuttle(shuttle)
-		logger.Info("Shuttle arrived at the destination successfully")
+		// The shuttles behind the head of an ordered route are not due until the head is done
+		if line, found := lp.lines[shuttle.Route.Username]; found && shuttle.Route.Ordered {
+			if head, _ := line.Head(); head != path {
+				continue
+			}
+		}
+
+		due := shuttle.Created
+		if shuttle.NextAttempt.After(due) {
+			due = shuttle.NextAttempt
+		}
+
+		if now.Sub(due) >= limit {
+			return fmt.Errorf("Queue has not moved since %s", lp.lastProgress.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
+
+// Snapshot returns a copy of the shuttles and the times the enroute shuttles were launched.
+func (lp *Launchpad) Snapshot() (map[string]Shuttle, map[string]time.Time) {
+	lp.ShuttlesMutex.Lock()
+	defer lp.ShuttlesMutex.Unlock()
+
+	shuttles := make(map[string]Shuttle, len(lp.Shuttles))
+	for path, shuttle := range lp.Shuttles {
+		shuttles[path] = shuttle
+	}
+
+	inFlight := make(map[string]time.Time, len(lp.InFlight))
+	for path, launched := range lp.InFlight {
+		inFlight[path] = launched
+	}
+
+	return shuttles, inFlight
+}
+
+// ScheduleShuttles moves shuttles waiting for a retry back to the queue when they are due.
+func (lp *Launchpad) ScheduleShuttles() {
+	lp.Schedule.Run(lp.Dispatcher)
+}
+
+// backoff returns the delay before the next attempt using exponential backoff with jitter.
+// The delay doubles after each attempt until it reaches Launchpad.RetryMax
+// and a random amount of up to half of the delay is subtracted from it.
+func (lp *Launchpad) backoff(attempts int) time.Duration {
+	delay := time.Duration(lp.Retry) * time.Second
+	limit := time.Duration(lp.RetryMax) * time.Second
+
+	for i := 1; i < attempts && delay < limit; i++ {
+		delay *= 2
+	}
+
+	if delay > limit {
+		delay = limit
+	}
 
-		lp.Enroute.Done()
+	if delay <= 0 {
+		return 0
 	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryAfter returns the delay requested by the endpoint limited to Launchpad.RetryMax
+// and to the time left before the shuttle runs out of its max_age, so that a far-off Retry-After
+// does not keep the shuttle waiting past its limits.
+func (lp *Launchpad) retryAfter(shuttle Shuttle, destination Destination, requested time.Duration) time.Duration {
+	if limit := time.Duration(lp.RetryMax) * time.Second; lp.RetryMax > 0 && requested > limit {
+		requested = limit
+	}
+
+	if _, maxAge := limits(shuttle, destination); maxAge > 0 && !shuttle.Created.IsZero() {
+		if left := time.Duration(maxAge) - time.Since(shuttle.Created); requested > left {
+			requested = left
+		}
+	}
+
+	if requested < 0 {
+		return 0
+	}
+
+	return requested
+}
+
+// exhausted returns the reason why the delivery of the shuttle to the destination should not be retried anymore,
+// or an empty string.
+func (lp *Launchpad) exhausted(shuttle Shuttle, destination Destination, delivery Delivery) string {
+	maxAttempts, maxAge := limits(shuttle, destination)
+
+	if maxAttempts > 0 && delivery.Attempts >= maxAttempts {
+		return fmt.Sprintf("Gave up after %d attempts", delivery.Attempts)
+	}
+
+	age := time.Since(shuttle.Created)
+	if maxAge > 0 && !shuttle.Created.IsZero() && age >= time.Duration(maxAge) {
+		return fmt.Sprintf("Gave up after %s and %d attempts", age.Round(time.Second), delivery.Attempts)
+	}
+
+	return ""
+}
+
+// limits returns the maximum attempts and age of the delivery of the shuttle to the destination.
+// The limits of the destination take precedence over the ones of the route.
+func limits(shuttle Shuttle, destination Destination) (int, Duration) {
+	maxAttempts := shuttle.Route.MaxAttempts
+	if destination.MaxAttempts > 0 {
+		maxAttempts = destination.MaxAttempts
+	}
+
+	maxAge := shuttle.Route.MaxAge
+	if destination.MaxAge > 0 {
+		maxAge = destination.MaxAge
+	}
+
+	return maxAttempts, maxAge
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStuckErrorIgnoresShuttlesWaitingInLine(t *testing.T) {
+	lp := NewLaunchpad(5, 3600, 60, 0, 30, "")
+
+	route := Route{
+		Username: "testuser",
+		Endpoint: "http://127.0.0.1/upload",
+		Ordered:  true,
+	}
+
+	now := time.Now()
+	lp.lastProgress = now.Add(-time.Hour)
+
+	// The head is waiting for a retry, the shuttles behind it have been waiting for an hour
+	for i, name := range []string{"file_001", "file_002", "file_003"} {
+		shuttle := NewShuttle(filepath.Join("/base/testuser", name), route)
+		shuttle.Created = now.Add(-time.Hour).Add(time.Duration(i) * time.Second)
+
+		if i == 0 {
+			shuttle.RetryAt(now.Add(time.Minute))
+		}
+
+		lp.Shuttles[shuttle.Path] = shuttle
+		lp.schedule(shuttle)
+	}
+
+	if err := lp.StuckError(); err != nil {
+		t.Fatalf("Expected the queue not to be stuck, got %v", err)
+	}
+
+	// A shuttle of an unordered route that has been due for an hour is stuck
+	unordered := NewShuttle("/base/other/file", Route{Username: "other", Endpoint: "http://127.0.0.1/upload"})
+	unordered.Created = now.Add(-time.Hour)
+
+	lp.Shuttles[unordered.Path] = unordered
+	lp.schedule(unordered)
+
+	if err := lp.StuckError(); err == nil {
+		t.Fatal("Expected the queue to be stuck")
+	}
+}
+
+func TestStuckErrorReportsOverdueHead(t *testing.T) {
+	lp := NewLaunchpad(5, 3600, 60, 0, 30, "")
+
+	route := Route{
+		Username: "testuser",
+		Endpoint: "http://127.0.0.1/upload",
+		Ordered:  true,
+	}
+
+	now := time.Now()
+	lp.lastProgress = now.Add(-time.Hour)
+
+	for _, name := range []string{"file_001", "file_002"} {
+		shuttle := NewShuttle(filepath.Join("/base/testuser", name), route)
+		shuttle.Created = now.Add(-time.Hour)
+
+		lp.Shuttles[shuttle.Path] = shuttle
+		lp.schedule(shuttle)
+	}
+
+	if err := lp.StuckError(); err == nil {
+		t.Fatal("Expected the queue to be stuck when the head of the line is overdue")
+	}
+}
+
+func TestRetryAfterIsLimited(t *testing.T) {
+	lp := NewLaunchpad(5, 3600, 60, 0, 30, "")
+
+	shuttle := Shuttle{
+		Created: time.Now(),
+	}
+
+	if delay := lp.retryAfter(shuttle, Destination{}, 10*time.Second); delay != 10*time.Second {
+		t.Errorf("Expected the requested delay to be honoured, got %s", delay)
+	}
+
+	if delay := lp.retryAfter(shuttle, Destination{}, 48*time.Hour); delay != time.Hour {
+		t.Errorf("Expected the delay to be limited to -retry-max, got %s", delay)
+	}
+
+	shuttle.Route.MaxAge = Duration(10 * time.Minute)
+	if delay := lp.retryAfter(shuttle, Destination{}, time.Hour); delay > 10*time.Minute || delay < 9*time.Minute {
+		t.Errorf("Expected the delay to be limited to the time left before max_age, got %s", delay)
+	}
+
+	destination := Destination{MaxAge: Duration(time.Minute)}
+	if delay := lp.retryAfter(shuttle, destination, time.Hour); delay > time.Minute {
+		t.Errorf("Expected the delay to be limited to the max_age of the destination, got %s", delay)
+	}
+
+	shuttle.Created = time.Now().Add(-time.Hour)
+	if delay := lp.retryAfter(shuttle, Destination{}, time.Hour); delay != 0 {
+		t.Errorf("Expected no delay past max_age, got %s", delay)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	lp := NewLaunchpad(10, 60, 60, 0, 30, "")
+
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, 60 * time.Second},
+		{100, 60 * time.Second},
+	}
+
+	// Up to half of the delay is subtracted as jitter
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if delay := lp.backoff(test.attempts); delay < test.delay/2 || delay > test.delay {
+				t.Fatalf("Delay after %d attempts is %s, expected between %s and %s", test.attempts, delay, test.delay/2, test.delay)
+			}
+		}
+	}
+
+	lp = NewLaunchpad(0, 60, 60, 0, 30, "")
+	if delay := lp.backoff(3); delay != 0 {
+		t.Errorf("Expected no delay without -retry, got %s", delay)
+	}
+}
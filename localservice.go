@@ -17,6 +17,7 @@ type LocalService struct {
 	routes             []Route
 	chroot             string
 	writeNotifications chan WriteNotification
+	state              *serviceState
 	watcher            *fsnotify.Watcher
 }
 
@@ -26,6 +27,7 @@ func NewLocalService(chroot string, routes []Route) *LocalService {
 		routes:             routes,
 		chroot:             chroot,
 		writeNotifications: make(chan WriteNotification, 100),
+		state:              newServiceState(),
 	}
 }
 
@@ -52,6 +54,8 @@ func (s *LocalService) Start() error {
 
 	go s.watch()
 
+	s.state.set(true, nil)
+
 	return nil
 }
 
@@ -77,6 +81,8 @@ func (s *LocalService) Reload(routes []Route) error {
 
 // Stop stops the server gracefully.
 func (s *LocalService) Stop() error {
+	s.state.set(false, nil)
+
 	// This is really nasty but it works
 	// Wait for the channels to be drained
 	for {
@@ -98,6 +104,11 @@ func (s *LocalService) Stop() error {
 	return nil
 }
 
+// Status returns the current status of the service.
+func (s *LocalService) Status() ServiceStatus {
+	return s.state.status(s.Name())
+}
+
 // WriteNotifications returns the file write notification channel.
 func (s *LocalService) WriteNotifications() chan WriteNotification {
 	return s.writeNotifications
@@ -124,10 +135,7 @@ func (s *LocalService) watch() {
 			}
 
 			username := filepath.Base(filepath.Dir(event.Name))
-			s.writeNotifications <- WriteNotification{
-				Username: username,
-				Path:     event.Name,
-			}
+			s.writeNotifications <- NewWriteNotification(username, event.Name, "")
 
 		case err := <-s.watcher.Errors:
 			// nil errors caused by a closed watcher
@@ -2,9 +2,11 @@ package main
 
 import (
 	"flag"
-	"io"
+	"fmt"
+	"math/rand"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -12,16 +14,36 @@ import (
 )
 
 func main() {
-	var configPath, shuttlesPath, privateKeyPath, certificatePublicPath, certificatePrivatePath, ftpHost, sftpHost, webHost string
-	var retry, workers, ftpPort, sftpPort, webPort, webInsecurePort int
-	var webAllowInsecure bool
+	// Administrative subcommands, e.g. "shuttle queue list"
+	if IsCommand(os.Args[1:]) {
+		if err := RunCommand(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	var configPath, shuttlesPath, auditPath, historyPath, privateKeyPath, certificatePublicPath, certificatePrivatePath, ftpHost, sftpHost, webHost, adminHost, probeHost string
+	var retry, retryMax, stuckAfter, breakerFailures, breakerCooldown, historyRetention, rescanInterval, rescanAge, workers, ftpPort, sftpPort, webPort, webInsecurePort, adminPort, probePort int
+	var webAllowInsecure, adminAllowInsecure bool
 
 	start := time.Now()
+	rand.Seed(start.UnixNano())
 
 	flag.StringVar(&configPath, "config", "/etc/shuttle/config.json", "Path to the config file")
 	flag.StringVar(&shuttlesPath, "shuttles", "/run/shuttle/shuttles.gob", "Path to the file that contains persisted shuttles")
+	flag.StringVar(&auditPath, "audit-log", "", "Path to the audit log that transfer events are appended to, empty to disable")
+	flag.StringVar(&historyPath, "history", "", "Path to the history of delivered and failed files, empty to disable")
+	flag.IntVar(&historyRetention, "history-retention", 90, "Days to keep the history of delivered and failed files for, 0 to keep it forever")
 	flag.IntVar(&retry, "retry", 5, "Delay before restarting error-inducing shuttles")
+	flag.IntVar(&retryMax, "retry-max", 3600, "Maximum delay before restarting error-inducing shuttles")
 	flag.IntVar(&workers, "workers", 5, "Concurrent uploads")
+	flag.IntVar(&breakerFailures, "breaker-failures", 5, "Consecutive failures of an endpoint host before its shuttles are parked, 0 to disable")
+	flag.IntVar(&breakerCooldown, "breaker-cooldown", 30, "Seconds to park the shuttles of a failing endpoint host before probing it again")
+	flag.IntVar(&stuckAfter, "stuck-after", 900, "Seconds the queue can go without progress while shuttles are waiting before it is reported stuck, 0 to disable")
+	flag.IntVar(&rescanInterval, "rescan-interval", 0, "Interval in seconds between rescans of the user folders for files without a shuttle, 0 to only rescan on startup")
+	flag.IntVar(&rescanAge, "rescan-age", 60, "Minimum age in seconds of a file before it is picked up by a rescan")
 
 	flag.StringVar(&privateKeyPath, "private-key", "", "Path to the private key file")
 	flag.StringVar(&certificatePublicPath, "certificate-public", "", "Path to the certificate file")
@@ -34,13 +56,29 @@ func main() {
 	flag.IntVar(&webPort, "web-port", 8081, "Port that the HTTPS web service will listen on")
 	flag.IntVar(&webInsecurePort, "web-insecure-port", 8080, "Port that the HTTP web service will listen on")
 	flag.BoolVar(&webAllowInsecure, "web-allow-insecure", false, "Allow access to web service over insecure connection")
+	flag.StringVar(&adminHost, "admin-host", "127.0.0.1", "Host that the admin API will listen on")
+	flag.IntVar(&adminPort, "admin-port", 8082, "Port that the admin API and metrics will listen on, 0 to disable")
+	flag.BoolVar(&adminAllowInsecure, "admin-allow-insecure", false, "Serve the admin API over an insecure connection")
+	flag.StringVar(&probeHost, "probe-host", "0.0.0.0", "Host that the health checks will be served on over plain HTTP")
+	flag.IntVar(&probePort, "probe-port", 0, "Port that the health checks will be served on over plain HTTP, 0 to disable")
 	flag.Parse()
 
 	logger := log.WithFields(log.Fields{
 		"path": configPath,
 	})
 
-	missionControl := NewMissionControl(retry, shuttlesPath)
+	if auditPath != "" {
+		var err error
+		auditLog, err = OpenAuditLog(auditPath)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"path": auditPath,
+				"err":  err,
+			}).Fatal("Failed to open audit log")
+		}
+	}
+
+	missionControl := NewMissionControl(retry, retryMax, stuckAfter, breakerFailures, breakerCooldown, rescanInterval, rescanAge, shuttlesPath)
 	if err := missionControl.Reload(configPath, privateKeyPath, certificatePublicPath, certificatePrivatePath, ftpHost, ftpPort, sftpHost, sftpPort, webHost, webPort, webInsecurePort, webAllowInsecure); err != nil {
 		logger.WithFields(log.Fields{
 			"err": err,
@@ -48,9 +86,47 @@ func main() {
 	}
 
 	logger = log.WithFields(log.Fields{
-		"base": missionControl.Configuration.Base,
+		"base": missionControl.Configuration().Base,
 	})
 
+	if historyPath != "" {
+		history, err := OpenHistory(historyPath, time.Duration(historyRetention)*24*time.Hour)
+		if err != nil {
+			logger.WithFields(log.Fields{
+				"path": historyPath,
+				"err":  err,
+			}).Fatal("Failed to open history")
+		}
+
+		if _, err := history.Prune(); err != nil {
+			logger.WithFields(log.Fields{
+				"path": historyPath,
+				"err":  err,
+			}).Error("Failed to prune history")
+		}
+
+		missionControl.Launchpad.History = history
+		go history.PrunePeriodically(time.Hour)
+	}
+
+	// Load in the old shuttles before any new ones can arrive so that they are persisted in the same journal
+	shuttlesLogger := logger.WithFields(log.Fields{
+		"path": shuttlesPath,
+	})
+
+	shuttlesLogger.Info("Loading in old shuttles")
+
+	count, err := missionControl.Launchpad.LoadShuttles()
+	if err != nil {
+		shuttlesLogger.WithFields(log.Fields{
+			"err": err,
+		}).Error("Failed to load old shuttles, continuing operation")
+	} else {
+		shuttlesLogger.WithFields(log.Fields{
+			"count": count,
+		}).Info("Loaded old shuttles")
+	}
+
 	if err := missionControl.Start(); err != nil {
 		logger.WithFields(log.Fields{
 			"err": err,
@@ -62,28 +138,79 @@ func main() {
 		go missionControl.Launchpad.LaunchShuttles()
 	}
 
+	// Launch a thread that queues new shuttles and the ones that should be retried
+	go missionControl.Launchpad.ScheduleShuttles()
+
+	// Pick up files that arrived but never got a shuttle, e.g. due to a crash
 	logger.WithFields(log.Fields{
-		"startup": time.Since(start),
-	}).Info("Ready and processing")
+		"count": missionControl.Rescan(),
+	}).Info("Rescanned user folders")
 
-	// Process in the old shuttles after start up
-	logger = logger.WithFields(log.Fields{
-		"path": shuttlesPath,
-	})
+	if rescanInterval > 0 {
+		go missionControl.RescanPeriodically()
+	}
 
-	logger.Info("Loading in old shuttles")
+	logger.WithFields(log.Fields{
+		"count": missionControl.PurgeArchives(),
+	}).Info("Purged archived files")
+
+	go missionControl.PurgeArchivesPeriodically()
+
+	requeued, removed := missionControl.CleanFailed()
+	logger.WithFields(log.Fields{
+		"requeued": requeued,
+		"removed":  removed,
+	}).Info("Cleaned failed folders")
+
+	go missionControl.CleanFailedPeriodically()
+
+	// Reloads can be requested both using SIGHUP and through the admin API
+	reloadMutex := &sync.Mutex{}
+	reload := func() error {
+		reloadMutex.Lock()
+		defer reloadMutex.Unlock()
+
+		return missionControl.Reload(configPath, privateKeyPath, certificatePublicPath, certificatePrivatePath, ftpHost, ftpPort, sftpHost, sftpPort, webHost, webPort, webInsecurePort, webAllowInsecure)
+	}
+
+	RegisterLaunchpadMetrics(&missionControl.Launchpad)
+
+	// Without admin credentials, only the metrics are available
+	var admin *AdminService
+	if adminPort != 0 {
+		admin = NewAdminService(adminHost, adminPort, adminAllowInsecure, &missionControl, reload)
+		if err := admin.Start(); err != nil {
+			logger.WithFields(log.Fields{
+				"err": err,
+			}).Fatal("Failed to start admin API")
+		}
 
-	count, err := missionControl.Launchpad.LoadShuttles()
-	if err != nil && err != io.EOF {
 		logger.WithFields(log.Fields{
-			"err": err,
-		}).Error("Failed to load old shuttles, continuing operation")
-	} else {
+			"host": adminHost,
+			"port": adminPort,
+		}).Info("Admin API started")
+	}
+
+	// Orchestrators usually cannot reach the admin API, which listens on localhost over TLS by default
+	var probe *ProbeService
+	if probePort != 0 {
+		probe = NewProbeService(probeHost, probePort, &missionControl)
+		if err := probe.Start(); err != nil {
+			logger.WithFields(log.Fields{
+				"err": err,
+			}).Fatal("Failed to start probe service")
+		}
+
 		logger.WithFields(log.Fields{
-			"count": count,
-		}).Info("Loaded old shuttles")
+			"host": probeHost,
+			"port": probePort,
+		}).Info("Probe service started")
 	}
 
+	logger.WithFields(log.Fields{
+		"startup": time.Since(start),
+	}).Info("Ready and processing")
+
 	// Handle a SIGHUP as reloading routes, gracefully handle SIGINT / SIGTERM
 	signalChannel := make(chan os.Signal, 3)
 	signal.Notify(signalChannel, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
@@ -91,7 +218,7 @@ func main() {
 		if sig == syscall.SIGHUP {
 			logger.Info("Reloading configuration")
 
-			if err := missionControl.Reload(configPath, privateKeyPath, certificatePublicPath, certificatePrivatePath, ftpHost, ftpPort, sftpHost, sftpPort, webHost, webPort, webInsecurePort, webAllowInsecure); err != nil {
+			if err := reload(); err != nil {
 				logger.WithFields(log.Fields{
 					"err": err,
 				}).Error("Failed to reload configuration")
@@ -104,7 +231,25 @@ func main() {
 
 		if sig == syscall.SIGINT || sig == syscall.SIGTERM {
 			logger.Info("Shutdown request received, waiting for clean exit...")
+
+			if admin != nil {
+				admin.Stop()
+			}
+
+			if probe != nil {
+				probe.Stop()
+			}
+
 			missionControl.Stop()
+
+			if auditLog != nil {
+				auditLog.Close()
+			}
+
+			if missionControl.Launchpad.History != nil {
+				missionControl.Launchpad.History.Close()
+			}
+
 			logger.Info("Clean exit complete, shutting down")
 
 			break
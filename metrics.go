@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics exposed by the admin API at /metrics.
+var (
+	filesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shuttle_files_received_total",
+		Help: "Files received from clients.",
+	}, []string{"service", "username"})
+
+	bytesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shuttle_received_bytes_total",
+		Help: "Bytes received from clients.",
+	}, []string{"service", "username"})
+
+	bytesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shuttle_sent_bytes_total",
+		Help: "Bytes sent to endpoints, including retries.",
+	}, []string{"username"})
+
+	attemptDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "shuttle_attempt_duration_seconds",
+		Help:    "Duration of delivery attempts.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"username", "outcome"})
+
+	deliveryLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "shuttle_delivery_latency_seconds",
+		Help:    "Time from receiving a file to delivering it, including retries.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 12),
+	}, []string{"username"})
+
+	httpResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shuttle_http_responses_total",
+		Help: "HTTP responses from endpoints by status code.",
+	}, []string{"endpoint", "code"})
+
+	retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shuttle_retries_total",
+		Help: "Delivery attempts that are going to be retried.",
+	}, []string{"username"})
+
+	failovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shuttle_failovers_total",
+		Help: "Destinations that failed over to their next endpoint, by primary endpoint.",
+	}, []string{"endpoint"})
+
+	circuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shuttle_circuit_open",
+		Help: "Whether the circuit of the endpoint host is open or half-open.",
+	}, []string{"endpoint"})
+
+	throttled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shuttle_throttled_total",
+		Help: "Deliveries parked by the request rate limit of the endpoint.",
+	}, []string{"endpoint"})
+
+	filesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shuttle_files_failed_total",
+		Help: "Files moved to a failed folder.",
+	}, []string{"username"})
+
+	failedFolderFiles = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shuttle_failed_folder_files",
+		Help: "Files in the failed folder.",
+	}, []string{"username"})
+
+	failedFolderBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shuttle_failed_folder_bytes",
+		Help: "Size of the files in the failed folder.",
+	}, []string{"username"})
+
+	sessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shuttle_sessions",
+		Help: "Active client sessions.",
+	}, []string{"service"})
+
+	authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "shuttle_auth_failures_total",
+		Help: "Failed client authentications.",
+	}, []string{"service"})
+)
+
+// RegisterLaunchpadMetrics registers the queue metrics of the launchpad.
+func RegisterLaunchpadMetrics(lp *Launchpad) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "shuttle_queue_depth",
+		Help: "Shuttles waiting to be sent, including the ones waiting for a retry.",
+	}, func() float64 {
+		queued, _ := lp.Counts()
+		return float64(queued)
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "shuttle_in_flight",
+		Help: "Shuttles that are being sent.",
+	}, func() float64 {
+		_, inFlight := lp.Counts()
+		return float64(inFlight)
+	})
+}
+
+// endpointLabel returns the host of the endpoint so that credentials and paths do not end up in the metrics.
+func endpointLabel(endpoint string) string {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return "invalid"
+	}
+
+	return parsed.Host
+}
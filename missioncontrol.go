@@ -3,24 +3,41 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type MissionControl struct {
-	Configuration Configuration
-	Launchpad     Launchpad
-	Services      []Service
+	configuration      Configuration
+	configurationMutex *sync.RWMutex
+	Launchpad          Launchpad
+	Services           []Service
+	RescanInterval     int
+	RescanAge          int
 }
 
-func NewMissionControl(retry int, shuttlesPath string) MissionControl {
-	launchpad := NewLaunchpad(retry, shuttlesPath)
+func NewMissionControl(retry int, retryMax int, stuckAfter int, breakerFailures int, breakerCooldown int, rescanInterval int, rescanAge int, shuttlesPath string) MissionControl {
+	launchpad := NewLaunchpad(retry, retryMax, stuckAfter, breakerFailures, breakerCooldown, shuttlesPath)
 
 	return MissionControl{
-		Launchpad: launchpad,
+		configurationMutex: &sync.RWMutex{},
+		Launchpad:          launchpad,
+		RescanInterval:     rescanInterval,
+		RescanAge:          rescanAge,
 	}
 }
 
+// Configuration returns the configuration in use. A reload replaces it as a whole,
+// so a caller that needs several of its fields should keep the returned copy.
+func (mc *MissionControl) Configuration() Configuration {
+	mc.configurationMutex.RLock()
+	defer mc.configurationMutex.RUnlock()
+
+	return mc.configuration
+}
+
 func (mc *MissionControl) Start() error {
 	if err := mc.createDirectories(); err != nil {
 		log.WithFields(log.Fields{
@@ -30,22 +47,23 @@ func (mc *MissionControl) Start() error {
 		return err
 	}
 
-	localRoutes, externalRoutes := SeparateRoutes(mc.Configuration.Routes)
+	configuration := mc.Configuration()
+	localRoutes, externalRoutes := SeparateRoutes(configuration.Routes)
 
 	// SFTP
-	sftp := NewSftpService(mc.Configuration.SftpHost, mc.Configuration.SftpPort, mc.Configuration.Base, externalRoutes, mc.Configuration.PrivateKey)
+	sftp := NewSftpService(configuration.SftpHost, configuration.SftpPort, configuration.Base, externalRoutes, configuration.PrivateKey)
 	mc.Services = append(mc.Services, sftp)
 
 	// FTP
-	ftp := NewFtpService(mc.Configuration.FtpHost, mc.Configuration.FtpPort, mc.Configuration.Base, mc.Configuration.Certificate, externalRoutes)
+	ftp := NewFtpService(configuration.FtpHost, configuration.FtpPort, configuration.Base, configuration.Certificate, externalRoutes)
 	mc.Services = append(mc.Services, ftp)
 
 	// Web
-	web := NewWebService(mc.Configuration.WebHost, mc.Configuration.WebPort, mc.Configuration.WebInsecurePort, mc.Configuration.WebAllowInsecure, mc.Configuration.Base, mc.Configuration.Certificate, externalRoutes)
+	web := NewWebService(configuration.WebHost, configuration.WebPort, configuration.WebInsecurePort, configuration.WebAllowInsecure, configuration.Base, configuration.Certificate, externalRoutes)
 	mc.Services = append(mc.Services, web)
 
 	// Local
-	local := NewLocalService(mc.Configuration.Base, localRoutes)
+	local := NewLocalService(configuration.Base, localRoutes)
 	mc.Services = append(mc.Services, local)
 
 	// Start up everything
@@ -59,7 +77,7 @@ func (mc *MissionControl) Start() error {
 			return err
 		}
 
-		go mc.WatchWriteNotifications(service.WriteNotifications())
+		go mc.WatchWriteNotifications(service.Name(), service.WriteNotifications())
 
 		log.WithFields(log.Fields{
 			"service": service.Name(),
@@ -84,13 +102,25 @@ func (mc *MissionControl) Stop() {
 	log.Info("Waiting for enroute shuttles to reach their destination...")
 
 	mc.Launchpad.Enroute.Wait()
+
+	if err := mc.Launchpad.Close(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warning("Failed to close journal")
+	}
 }
 
-func (mc *MissionControl) WatchWriteNotifications(writeNotifications chan WriteNotification) {
+func (mc *MissionControl) WatchWriteNotifications(name string, writeNotifications chan WriteNotification) {
 	for writeNotification := range writeNotifications {
-		shuttle, err := NewShuttleFromUsername(writeNotification.Path, writeNotification.Username, mc.Configuration.Routes)
+		filesReceived.WithLabelValues(name, writeNotification.Username).Inc()
+		if fileinfo, err := os.Stat(writeNotification.Path); err == nil {
+			bytesReceived.WithLabelValues(name, writeNotification.Username).Add(float64(fileinfo.Size()))
+		}
+
+		shuttle, err := NewShuttleFromUsername(writeNotification.Path, writeNotification.Username, mc.Configuration().Routes)
 		if err != nil {
 			log.WithFields(log.Fields{
+				"transfer": writeNotification.TransferID,
 				"username": writeNotification.Username,
 				"path":     writeNotification.Path,
 				"err":      err,
@@ -98,17 +128,47 @@ func (mc *MissionControl) WatchWriteNotifications(writeNotifications chan WriteN
 			continue
 		}
 
-		mc.Launchpad.AddShuttle(shuttle)
+		shuttle.TransferID = writeNotification.TransferID
+		shuttle.Protocol = name
+		shuttle.ClientIP = writeNotification.ClientIP
+
+		mc.receive(shuttle)
 	}
 }
 
+// receive records the file of the shuttle as received in the audit log and adds the shuttle to the launchpad.
+func (mc *MissionControl) receive(shuttle Shuttle) {
+	if fileinfo, err := os.Stat(shuttle.Path); err == nil {
+		shuttle.Size = fileinfo.Size()
+	}
+
+	// The digest is only needed for the audit log and the history
+	if auditLog != nil || mc.Launchpad.History != nil {
+		digest, err := HashFile(shuttle.Path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"transfer": shuttle.TransferID,
+				"path":     shuttle.Path,
+				"err":      err,
+			}).Error("Failed to hash received file")
+		}
+
+		shuttle.SHA256 = digest
+	}
+
+	auditLog.Record(NewAuditEvent(AuditReceived, shuttle))
+	mc.Launchpad.AddShuttle(shuttle)
+}
+
 func (mc *MissionControl) Reload(path string, privateKeyPath string, certificatePublicPath string, certificatePrivatePath string, ftpHost string, ftpPort int, sftpHost string, sftpPort int, webHost string, webPort int, webInsecurePort int, webAllowInsecure bool) error {
 	configuration, err := NewConfiguration(path, privateKeyPath, certificatePublicPath, certificatePrivatePath, ftpHost, ftpPort, sftpHost, sftpPort, webHost, webPort, webInsecurePort, webAllowInsecure)
 	if err != nil {
 		return err
 	}
 
-	mc.Configuration = configuration
+	mc.configurationMutex.Lock()
+	mc.configuration = configuration
+	mc.configurationMutex.Unlock()
 
 	if err := mc.createDirectories(); err != nil {
 		log.WithFields(log.Fields{
@@ -118,7 +178,7 @@ func (mc *MissionControl) Reload(path string, privateKeyPath string, certificate
 		return err
 	}
 
-	localRoutes, externalRoutes := SeparateRoutes(mc.Configuration.Routes)
+	localRoutes, externalRoutes := SeparateRoutes(configuration.Routes)
 	for _, service := range mc.Services {
 		if _, ok := service.(*LocalService); ok {
 			service.Reload(localRoutes)
@@ -130,9 +190,208 @@ func (mc *MissionControl) Reload(path string, privateKeyPath string, certificate
 	return nil
 }
 
+// Rescan walks through the user folders, except for the failed folders, and adds a shuttle for
+// every file that is not known by the launchpad. This recovers files whose shuttle was never persisted,
+// for example due to a crash or a missed write notification. Files modified within
+// MissionControl.RescanAge seconds are skipped since they might still be being written to.
+func (mc *MissionControl) Rescan() int {
+	configuration := mc.Configuration()
+	cutoff := time.Now().Add(-time.Duration(mc.RescanAge) * time.Second)
+	count := 0
+
+	for _, route := range configuration.Routes {
+		root := filepath.Join(configuration.Base, route.Username)
+		failed := filepath.Join(root, "failed")
+
+		err := filepath.Walk(root, func(path string, fileinfo os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if fileinfo.IsDir() {
+				if path == failed {
+					return filepath.SkipDir
+				}
+
+				return nil
+			}
+
+			if !fileinfo.Mode().IsRegular() || fileinfo.ModTime().After(cutoff) {
+				return nil
+			}
+
+			shuttle := NewShuttle(path, route)
+			if mc.Launchpad.HasShuttle(shuttle) {
+				return nil
+			}
+
+			shuttle.Protocol = "rescan"
+
+			log.WithFields(log.Fields{
+				"transfer": shuttle.TransferID,
+				"username": route.Username,
+				"path":     path,
+			}).Warning("Found a file without a shuttle, adding it")
+
+			mc.receive(shuttle)
+			count++
+
+			return nil
+		})
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"username": route.Username,
+				"err":      err,
+			}).Error("Failed to rescan user folder")
+		}
+	}
+
+	return count
+}
+
+// RescanPeriodically calls MissionControl.Rescan every MissionControl.RescanInterval seconds, it never returns.
+func (mc *MissionControl) RescanPeriodically() {
+	for range time.Tick(time.Duration(mc.RescanInterval) * time.Second) {
+		mc.Rescan()
+	}
+}
+
+// CleanFailed applies the failed folder policies of the routes, requeueing and removing files,
+// and updates the failed folder metrics of every route. Returns the amount of requeued and removed files.
+func (mc *MissionControl) CleanFailed() (int, int) {
+	configuration := mc.Configuration()
+	requeued, removed := 0, 0
+
+	for _, route := range configuration.Routes {
+		logger := log.WithFields(log.Fields{
+			"username": route.Username,
+		})
+
+		files, err := ListFailed(configuration.Base, route.Username)
+		if err != nil {
+			logger.WithFields(log.Fields{
+				"err": err,
+			}).Error("Failed to list failed folder")
+			continue
+		}
+
+		if route.Failed != nil {
+			remaining := []FailedFile{}
+
+			for _, file := range files {
+				if !route.Failed.Requeue(file) {
+					remaining = append(remaining, file)
+					continue
+				}
+
+				path, err := RequeueFailed(configuration.Base, route.Username, file.Name)
+				if err != nil {
+					logger.WithFields(log.Fields{
+						"file": file.Name,
+						"err":  err,
+					}).Error("Failed to requeue failed file")
+
+					remaining = append(remaining, file)
+					continue
+				}
+
+				shuttle := NewRequeuedShuttle(path, route, file)
+
+				logger.WithFields(log.Fields{
+					"transfer": shuttle.TransferID,
+					"file":     file.Name,
+					"requeues": shuttle.Requeues,
+				}).Info("Requeueing failed file after cool-down")
+
+				mc.receive(shuttle)
+				requeued++
+			}
+
+			files = remaining
+
+			expired := route.Failed.Expired(files)
+			for _, file := range expired {
+				if err := RemoveFailed(configuration.Base, route.Username, file.Name); err != nil {
+					logger.WithFields(log.Fields{
+						"file": file.Name,
+						"err":  err,
+					}).Error("Failed to remove failed file")
+					continue
+				}
+
+				logger.WithFields(log.Fields{
+					"transfer": file.TransferID,
+					"file":     file.Name,
+					"failed":   file.Failed,
+					"reason":   file.Reason,
+				}).Warning("Removed failed file due to the failed folder policy")
+
+				removed++
+			}
+
+			files = files[len(expired):]
+		}
+
+		var size int64
+		for _, file := range files {
+			size += file.Size
+		}
+
+		failedFolderFiles.WithLabelValues(route.Username).Set(float64(len(files)))
+		failedFolderBytes.WithLabelValues(route.Username).Set(float64(size))
+	}
+
+	return requeued, removed
+}
+
+// CleanFailedPeriodically calls MissionControl.CleanFailed every 5 minutes, it never returns.
+func (mc *MissionControl) CleanFailedPeriodically() {
+	for range time.Tick(5 * time.Minute) {
+		mc.CleanFailed()
+	}
+}
+
+// PurgeArchives purges the archives of the routes and returns the amount of purged files.
+func (mc *MissionControl) PurgeArchives() int {
+	count := 0
+
+	for _, route := range mc.Configuration().Routes {
+		if route.Archive == nil {
+			continue
+		}
+
+		purged, err := route.Archive.Purge()
+		count += purged
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"username": route.Username,
+				"path":     route.Archive.Path,
+				"err":      err,
+			}).Error("Failed to purge archive")
+		}
+	}
+
+	return count
+}
+
+// PurgeArchivesPeriodically calls MissionControl.PurgeArchives every hour, it never returns.
+func (mc *MissionControl) PurgeArchivesPeriodically() {
+	for range time.Tick(time.Hour) {
+		if purged := mc.PurgeArchives(); purged > 0 {
+			log.WithFields(log.Fields{
+				"count": purged,
+			}).Info("Purged archived files")
+		}
+	}
+}
+
 func (mc *MissionControl) createDirectories() error {
-	for _, route := range mc.Configuration.Routes {
-		path := filepath.Join(mc.Configuration.Base, route.Username, "failed")
+	configuration := mc.Configuration()
+
+	for _, route := range configuration.Routes {
+		path := filepath.Join(configuration.Base, route.Username, "failed")
 		if err := os.MkdirAll(path, 0755); err != nil {
 			return err
 		}
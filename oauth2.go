@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth2 contains the client credentials used to acquire access tokens for an endpoint.
+type OAuth2 struct {
+	TokenURL          string   `json:"token_url"`
+	ClientID          string   `json:"client_id"`
+	ClientSecret      string   `json:"client_secret"`
+	Scopes            []string `json:"scopes"`
+	CredentialsInBody bool     `json:"credentials_in_body"`
+}
+
+type oauth2Token struct {
+	accessToken string
+	expires     time.Time
+}
+
+// oauth2Entry is the cached token of a single set of client credentials. Its mutex is held while
+// a new token is requested, so that concurrent sends wait for the same request instead of making their own.
+type oauth2Entry struct {
+	token oauth2Token
+	mutex *sync.Mutex
+}
+
+// oauth2Tokens caches access tokens between sends, shared by all shuttles. The mutex only guards the map,
+// so that a slow token endpoint does not hold up the sends that use other credentials.
+var oauth2Tokens = struct {
+	entries map[string]*oauth2Entry
+	mutex   *sync.Mutex
+}{
+	entries: make(map[string]*oauth2Entry),
+	mutex:   &sync.Mutex{},
+}
+
+// Token returns a cached access token or requests a new one using the client credentials grant.
+// If refresh is true, a new token is requested even if the cached one has not expired yet.
+func (o OAuth2) Token(refresh bool) (string, error) {
+	key := strings.Join([]string{o.TokenURL, o.ClientID, strings.Join(o.Scopes, " ")}, "\n")
+
+	oauth2Tokens.mutex.Lock()
+	entry, found := oauth2Tokens.entries[key]
+	if !found {
+		entry = &oauth2Entry{mutex: &sync.Mutex{}}
+		oauth2Tokens.entries[key] = entry
+	}
+	oauth2Tokens.mutex.Unlock()
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	token := entry.token
+	if token.accessToken != "" && !refresh && (token.expires.IsZero() || time.Now().Before(token.expires)) {
+		return token.accessToken, nil
+	}
+
+	token, err := o.requestToken()
+	if err != nil {
+		entry.token = oauth2Token{}
+		return "", err
+	}
+
+	entry.token = token
+	return token.accessToken, nil
+}
+
+func (o OAuth2) requestToken() (oauth2Token, error) {
+	var token oauth2Token
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(o.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.Scopes, " "))
+	}
+
+	if o.CredentialsInBody {
+		form.Set("client_id", o.ClientID)
+		form.Set("client_secret", o.ClientSecret)
+	}
+
+	request, err := http.NewRequest("POST", o.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return token, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	if !o.CredentialsInBody {
+		request.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return token, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		io.Copy(ioutil.Discard, response.Body)
+		return token, fmt.Errorf("Token endpoint returned %d", response.StatusCode)
+	}
+
+	var payload struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&payload); err != nil {
+		return token, err
+	}
+
+	if payload.AccessToken == "" {
+		return token, fmt.Errorf("Token endpoint returned no access token")
+	}
+
+	if payload.TokenType != "" && !strings.EqualFold(payload.TokenType, "bearer") {
+		return token, fmt.Errorf("Unsupported token type %q", payload.TokenType)
+	}
+
+	token.accessToken = payload.AccessToken
+
+	// Renew a bit early so that the token does not expire during an upload
+	if payload.ExpiresIn > 0 {
+		lifetime := time.Duration(payload.ExpiresIn) * time.Second
+		margin := lifetime / 10
+		if margin > time.Minute {
+			margin = time.Minute
+		}
+
+		token.expires = time.Now().Add(lifetime - margin)
+	}
+
+	return token, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Orders of the files of an ordered route.
+const (
+	OrderArrival  = "arrival"
+	OrderFilename = "filename"
+)
+
+// lineEntry is a shuttle waiting in a Line.
+type lineEntry struct {
+	path    string
+	created time.Time
+}
+
+// Line keeps the shuttles of an ordered route in the order they must be delivered in.
+// Only the shuttle at the head of the line may be launched, the rest wait until it has been
+// delivered or has failed, no matter how long it is waiting for a retry.
+type Line struct {
+	orderBy string
+	entries []lineEntry
+	enroute string
+}
+
+// NewLine creates a new, empty Line that orders the shuttles by their arrival or by their filename.
+func NewLine(orderBy string) *Line {
+	return &Line{
+		orderBy: orderBy,
+	}
+}
+
+// Head returns the path of the shuttle at the head of the line, false if the line is empty.
+func (l *Line) Head() (string, bool) {
+	if len(l.entries) == 0 {
+		return "", false
+	}
+
+	return l.entries[0].path, true
+}
+
+// Add places the shuttle in the line and returns whether it became the head of the line.
+func (l *Line) Add(shuttle Shuttle) bool {
+	entry := lineEntry{
+		path:    shuttle.Path,
+		created: shuttle.Created,
+	}
+
+	i := sort.Search(len(l.entries), func(i int) bool {
+		return l.before(entry, l.entries[i])
+	})
+
+	l.entries = append(l.entries, lineEntry{})
+	copy(l.entries[i+1:], l.entries[i:])
+	l.entries[i] = entry
+
+	return i == 0
+}
+
+// Remove removes the shuttle from the line.
+func (l *Line) Remove(path string) {
+	for i, entry := range l.entries {
+		if entry.path == path {
+			l.entries = append(l.entries[:i], l.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// Claim marks the shuttle enroute and returns true if it is at the head of the line
+// and no other shuttle of the line is enroute.
+func (l *Line) Claim(path string) bool {
+	if head, found := l.Head(); !found || head != path || l.enroute != "" {
+		return false
+	}
+
+	l.enroute = path
+	return true
+}
+
+// Release marks the shuttle as no longer enroute.
+func (l *Line) Release(path string) {
+	if l.enroute == path {
+		l.enroute = ""
+	}
+}
+
+func (l *Line) before(a lineEntry, b lineEntry) bool {
+	if l.orderBy == OrderFilename {
+		if nameA, nameB := filepath.Base(a.path), filepath.Base(b.path); nameA != nameB {
+			return nameA < nameB
+		}
+	} else if !a.created.Equal(b.created) {
+		return a.created.Before(b.created)
+	}
+
+	return a.path < b.path
+}
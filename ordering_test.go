@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLineOrdersByArrival(t *testing.T) {
+	line := NewLine(OrderArrival)
+	now := time.Now()
+
+	if !line.Add(Shuttle{Path: "/base/user/second", Created: now}) {
+		t.Error("Expected the first shuttle to become the head of the line")
+	}
+
+	if line.Add(Shuttle{Path: "/base/user/third", Created: now.Add(time.Second)}) {
+		t.Error("Expected a later shuttle to wait in line")
+	}
+
+	if !line.Add(Shuttle{Path: "/base/user/first", Created: now.Add(-time.Second)}) {
+		t.Error("Expected an earlier shuttle to become the head of the line")
+	}
+
+	for _, expected := range []string{"/base/user/first", "/base/user/second", "/base/user/third"} {
+		head, found := line.Head()
+		if !found || head != expected {
+			t.Fatalf("Head of the line is %q, expected %q", head, expected)
+		}
+
+		line.Remove(head)
+	}
+
+	if _, found := line.Head(); found {
+		t.Error("Expected the line to be empty")
+	}
+}
+
+func TestLineOrdersByFilename(t *testing.T) {
+	line := NewLine(OrderFilename)
+	now := time.Now()
+
+	line.Add(Shuttle{Path: "/base/user/b.csv", Created: now})
+	line.Add(Shuttle{Path: "/base/user/sub/a.csv", Created: now.Add(time.Second)})
+
+	if head, _ := line.Head(); head != "/base/user/sub/a.csv" {
+		t.Errorf("Head of the line is %q, expected the first filename", head)
+	}
+}
+
+func TestLineClaim(t *testing.T) {
+	line := NewLine(OrderArrival)
+	now := time.Now()
+
+	line.Add(Shuttle{Path: "head", Created: now})
+	line.Add(Shuttle{Path: "next", Created: now.Add(time.Second)})
+
+	if line.Claim("next") {
+		t.Error("Expected a shuttle behind the head not to be claimed")
+	}
+
+	if !line.Claim("head") {
+		t.Fatal("Expected the head of the line to be claimed")
+	}
+
+	if line.Claim("head") {
+		t.Error("Expected the head not to be claimed twice while it is enroute")
+	}
+
+	// The head failed and was taken out of the line
+	line.Release("head")
+	line.Remove("head")
+
+	if !line.Claim("next") {
+		t.Error("Expected the next shuttle to be claimed once the head was done")
+	}
+}
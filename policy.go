@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Outcome is the meaning of a HTTP status code returned by an endpoint.
+type Outcome int
+
+const (
+	// OutcomeSuccess means that the endpoint accepted the file.
+	OutcomeSuccess Outcome = iota
+	// OutcomeRetry means that the transfer should be retried later.
+	OutcomeRetry
+	// OutcomePermanent means that the endpoint rejected the file for good.
+	OutcomePermanent
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeSuccess:
+		return "success"
+	case OutcomeRetry:
+		return "retry"
+	default:
+		return "permanent"
+	}
+}
+
+// Policy lists which HTTP status codes mean success, retry or a permanent failure.
+// A status code is given either exactly, e.g. "503", or as a class, e.g. "5xx".
+// Exact status codes take precedence over classes and unlisted status codes are permanent failures.
+// A list that is left out of the configuration uses the default, an empty list is allowed.
+type Policy struct {
+	Success   []string `json:"success"`
+	Retry     []string `json:"retry"`
+	Permanent []string `json:"permanent"`
+}
+
+var (
+	defaultSuccessCodes = []string{"2xx"}
+	defaultRetryCodes   = []string{"408", "429", "502", "503", "504"}
+)
+
+// Validate checks that all the status codes of the policy are well-formed.
+func (p Policy) Validate() error {
+	for _, codes := range [][]string{p.Success, p.Retry, p.Permanent} {
+		for _, code := range codes {
+			if !validStatusPattern(code) {
+				return fmt.Errorf("Invalid status code %q in policy", code)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Classify returns the outcome of the status code.
+func (p Policy) Classify(statusCode int) Outcome {
+	success := p.Success
+	if success == nil {
+		success = defaultSuccessCodes
+	}
+
+	retry := p.Retry
+	if retry == nil {
+		retry = defaultRetryCodes
+	}
+
+	lists := []struct {
+		codes   []string
+		outcome Outcome
+	}{
+		{success, OutcomeSuccess},
+		{retry, OutcomeRetry},
+		{p.Permanent, OutcomePermanent},
+	}
+
+	exact := strconv.Itoa(statusCode)
+	class := fmt.Sprintf("%dxx", statusCode/100)
+
+	for _, pattern := range []string{exact, class} {
+		for _, list := range lists {
+			for _, code := range list.codes {
+				if strings.ToLower(code) == pattern {
+					return list.outcome
+				}
+			}
+		}
+	}
+
+	return OutcomePermanent
+}
+
+func validStatusPattern(pattern string) bool {
+	if len(pattern) != 3 || pattern[0] < '1' || pattern[0] > '5' {
+		return false
+	}
+
+	if strings.ToLower(pattern[1:]) == "xx" {
+		return true
+	}
+
+	_, err := strconv.Atoi(pattern)
+	return err == nil
+}
+
+// ParseRetryAfter returns the delay requested using a Retry-After header or zero if there is none.
+// The header can contain either a delay in seconds or a HTTP date.
+// Negative delays and delays too long to be represented are ignored.
+func ParseRetryAfter(header string) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.ParseInt(header, 10, 64); err == nil {
+		if seconds < 0 || seconds > math.MaxInt64/int64(time.Second) {
+			return 0
+		}
+
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+
+	return 0
+}
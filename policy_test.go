@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		delay  time.Duration
+	}{
+		{"", 0},
+		{"120", 120 * time.Second},
+		{" 5 ", 5 * time.Second},
+		{"-5", 0},
+		{"9223372036854775807", 0},
+		{"99999999999999999999", 0},
+		{"soon", 0},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+	}
+
+	for _, test := range tests {
+		if delay := ParseRetryAfter(test.header); delay != test.delay {
+			t.Errorf("Retry-After %q gave %s, expected %s", test.header, delay, test.delay)
+		}
+	}
+
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if delay := ParseRetryAfter(date); delay <= 59*time.Minute || delay > time.Hour {
+		t.Errorf("Retry-After %q gave %s, expected about an hour", date, delay)
+	}
+}
+
+func TestPolicyClassify(t *testing.T) {
+	tests := []struct {
+		policy     Policy
+		statusCode int
+		outcome    Outcome
+	}{
+		{Policy{}, 200, OutcomeSuccess},
+		{Policy{}, 204, OutcomeSuccess},
+		{Policy{}, 503, OutcomeRetry},
+		{Policy{}, 429, OutcomeRetry},
+		{Policy{}, 500, OutcomePermanent},
+		{Policy{}, 404, OutcomePermanent},
+		{Policy{Retry: []string{"5xx"}}, 500, OutcomeRetry},
+		{Policy{Retry: []string{}}, 503, OutcomePermanent},
+		{Policy{Success: []string{"200"}}, 202, OutcomePermanent},
+		{Policy{Retry: []string{"5XX"}, Permanent: []string{"501"}}, 501, OutcomePermanent},
+		{Policy{Retry: []string{"5xx"}, Permanent: []string{"501"}}, 502, OutcomeRetry},
+		{Policy{Success: []string{"409"}}, 409, OutcomeSuccess},
+	}
+
+	for _, test := range tests {
+		if outcome := test.policy.Classify(test.statusCode); outcome != test.outcome {
+			t.Errorf("%+v classified %d as %s, expected %s", test.policy, test.statusCode, outcome, test.outcome)
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	valid := Policy{Success: []string{"2xx", "304"}, Retry: []string{"5XX"}, Permanent: []string{"404"}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected %+v to be valid, got %v", valid, err)
+	}
+
+	for _, code := range []string{"", "20", "2000", "6xx", "0xx", "2x0", "abc"} {
+		if err := (Policy{Retry: []string{code}}).Validate(); err == nil {
+			t.Errorf("Expected status code %q to be rejected", code)
+		}
+	}
+}
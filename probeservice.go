@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ProbeService serves the liveness and readiness checks over plain HTTP without authentication,
+// so that an orchestrator can probe Shuttle on an address that the admin API does not listen on.
+// It is not a Service since it does not receive files.
+type ProbeService struct {
+	host           string
+	port           int
+	missionControl *MissionControl
+	server         *http.Server
+}
+
+// NewProbeService creates a new ProbeService.
+func NewProbeService(host string, port int, missionControl *MissionControl) *ProbeService {
+	return &ProbeService{
+		host:           host,
+		port:           port,
+		missionControl: missionControl,
+	}
+}
+
+// Start starts the service.
+func (s *ProbeService) Start() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health/live", serveHealth(s.missionControl.Liveness))
+	mux.HandleFunc("/health/ready", serveHealth(s.missionControl.Readiness))
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.host, s.port))
+	if err != nil {
+		return err
+	}
+
+	s.server = &http.Server{
+		Handler: mux,
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("Probe service crashed")
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the service gracefully.
+func (s *ProbeService) Stop() error {
+	return s.server.Shutdown(context.Background())
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// throttleChunk is the largest amount of bytes that is read at once from a shaped request body.
+const throttleChunk = 32 * 1024
+
+// RateLimit limits the requests and the bandwidth used for an endpoint. Zero values disable the limits.
+// The limits are shared by every route that sends to the same endpoint.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+	BytesPerSecond    int64   `json:"bytes_per_second"`
+}
+
+// Validate returns an error if the rate limit cannot be used.
+func (l RateLimit) Validate() error {
+	if l.RequestsPerSecond < 0 || l.Burst < 0 || l.BytesPerSecond < 0 {
+		return errors.New("Rate limits must not be negative")
+	}
+
+	return nil
+}
+
+// TokenBucket is a token bucket that is refilled at a rate of tokens per second, up to burst tokens.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  *sync.Mutex
+}
+
+// NewTokenBucket creates a new, full TokenBucket.
+func NewTokenBucket(rate float64, burst float64) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// Unexported since it relies on TokenBucket.mutex being locked
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	b.last = now
+}
+
+// Reserve takes n tokens from the bucket and returns how long the caller has to wait before using them.
+// The bucket can go into debt so that the callers are served in the order they reserved their tokens.
+func (b *TokenBucket) Reserve(n float64) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(time.Now())
+	b.tokens -= n
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait takes n tokens from the bucket, blocking until the bucket has had time to refill them.
+func (b *TokenBucket) Wait(n float64) {
+	time.Sleep(b.Reserve(n))
+}
+
+type endpointLimiter struct {
+	requests *TokenBucket
+	bytes    *TokenBucket
+}
+
+// rateLimiters holds the token buckets of every rate limited endpoint, shared by all shuttles.
+// The buckets are keyed by both the endpoint and the limits, so that routes that send to the same
+// endpoint with different limits do not reset each other's buckets.
+var rateLimiters = struct {
+	limiters map[string]*endpointLimiter
+	mutex    *sync.Mutex
+}{
+	limiters: make(map[string]*endpointLimiter),
+	mutex:    &sync.Mutex{},
+}
+
+// limiter returns the token buckets of the endpoint with these limits.
+func (l RateLimit) limiter(endpoint string) *endpointLimiter {
+	rateLimiters.mutex.Lock()
+	defer rateLimiters.mutex.Unlock()
+
+	key := fmt.Sprintf("%s\n%g\n%d\n%d", endpoint, l.RequestsPerSecond, l.Burst, l.BytesPerSecond)
+
+	limiter, found := rateLimiters.limiters[key]
+	if found {
+		return limiter
+	}
+
+	limiter = &endpointLimiter{}
+
+	if l.RequestsPerSecond > 0 {
+		burst := float64(l.Burst)
+		if burst < 1 {
+			burst = 1
+		}
+
+		limiter.requests = NewTokenBucket(l.RequestsPerSecond, burst)
+	}
+
+	if l.BytesPerSecond > 0 {
+		limiter.bytes = NewTokenBucket(float64(l.BytesPerSecond), float64(l.BytesPerSecond))
+	}
+
+	rateLimiters.limiters[key] = limiter
+	return limiter
+}
+
+// Reserve reserves a request to the endpoint and returns the time when it can be sent,
+// or a zero time if it can be sent right away, which is always the case if the rate limit is nil.
+func (l *RateLimit) Reserve(endpoint string) time.Time {
+	if l == nil || l.RequestsPerSecond <= 0 {
+		return time.Time{}
+	}
+
+	wait := l.limiter(endpoint).requests.Reserve(1)
+	if wait <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(wait)
+}
+
+// Shape returns the request body limited to the bandwidth of the endpoint.
+// Returns the body as is if the rate limit is nil.
+func (l *RateLimit) Shape(endpoint string, body io.ReadCloser) io.ReadCloser {
+	if l == nil || l.BytesPerSecond <= 0 {
+		return body
+	}
+
+	return &throttledReader{
+		ReadCloser: body,
+		bucket:     l.limiter(endpoint).bytes,
+		chunk:      int(l.BytesPerSecond),
+	}
+}
+
+// throttledReader waits for a token for every byte that is read.
+type throttledReader struct {
+	io.ReadCloser
+	bucket *TokenBucket
+	chunk  int
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	chunk := r.chunk
+	if chunk > throttleChunk {
+		chunk = throttleChunk
+	}
+
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.bucket.Wait(float64(n))
+	}
+
+	return n, err
+}
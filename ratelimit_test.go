@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	bucket := NewTokenBucket(10, 2)
+
+	// The burst is available right away
+	for i := 0; i < 2; i++ {
+		if delay := bucket.Reserve(1); delay != 0 {
+			t.Fatalf("Expected token %d to be available right away, got a delay of %s", i+1, delay)
+		}
+	}
+
+	// After that the callers are served in order, a token every 100 milliseconds
+	for i := 1; i <= 3; i++ {
+		expected := time.Duration(i) * 100 * time.Millisecond
+		if delay := bucket.Reserve(1); delay < expected-20*time.Millisecond || delay > expected {
+			t.Errorf("Expected reservation %d to wait about %s, got %s", i, expected, delay)
+		}
+	}
+}
+
+func TestTokenBucketRefills(t *testing.T) {
+	bucket := NewTokenBucket(100, 1)
+
+	if delay := bucket.Reserve(1); delay != 0 {
+		t.Fatalf("Expected the first token to be available right away, got a delay of %s", delay)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	// The bucket refills no further than the burst
+	if delay := bucket.Reserve(1); delay != 0 {
+		t.Errorf("Expected the bucket to have refilled, got a delay of %s", delay)
+	}
+
+	if delay := bucket.Reserve(1); delay == 0 {
+		t.Error("Expected the bucket to hold no more than the burst")
+	}
+}
+
+// The buckets are shared by the whole process, every test uses an endpoint of its own.
+func TestRateLimitsOfSameEndpointDoNotResetEachOther(t *testing.T) {
+	endpoint := fmt.Sprintf("http://127.0.0.1/rate-limit-test/%d", time.Now().UnixNano())
+	slow := &RateLimit{RequestsPerSecond: 0.1}
+	slower := &RateLimit{RequestsPerSecond: 0.2, Burst: 1}
+
+	// Both limits allow a single request right away, after which every request has to wait
+	for i := 0; i < 5; i++ {
+		slowReserved := slow.Reserve(endpoint)
+		slowerReserved := slower.Reserve(endpoint)
+
+		if i == 0 {
+			if !slowReserved.IsZero() || !slowerReserved.IsZero() {
+				t.Fatal("Expected the first requests to be allowed right away")
+			}
+
+			continue
+		}
+
+		if slowReserved.IsZero() || slowerReserved.IsZero() {
+			t.Fatalf("Expected request %d to be parked by both limits", i+1)
+		}
+	}
+}
+
+func TestRateLimitsAreSharedBySameLimits(t *testing.T) {
+	endpoint := fmt.Sprintf("http://127.0.0.1/rate-limit-shared-test/%d", time.Now().UnixNano())
+	first := &RateLimit{RequestsPerSecond: 0.5}
+	second := &RateLimit{RequestsPerSecond: 0.5}
+
+	if reserved := first.Reserve(endpoint); !reserved.IsZero() {
+		t.Fatal("Expected the first request to be allowed right away")
+	}
+
+	if reserved := second.Reserve(endpoint); reserved.IsZero() {
+		t.Fatal("Expected a route with the same limits to share the bucket")
+	}
+}
@@ -1,8 +1,140 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
 type Route struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Endpoint string `json:"endpoint"`
-	Local    bool   `json:"local"`
+	Username          string            `json:"username"`
+	Password          string            `json:"password"`
+	Endpoint          string            `json:"endpoint"`
+	Failover          []string          `json:"failover"`
+	FailoverAfter     int               `json:"failover_after"`
+	FailoverProbe     Duration          `json:"failover_probe"`
+	Local             bool              `json:"local"`
+	Headers           map[string]string `json:"headers"`
+	BearerToken       string            `json:"bearer_token"`
+	BearerTokenFile   string            `json:"bearer_token_file"`
+	BearerTokenEnv    string            `json:"bearer_token_env"`
+	OAuth2            *OAuth2           `json:"oauth2"`
+	ClientCertificate string            `json:"client_certificate"`
+	ClientKey         string            `json:"client_key"`
+	CABundle          string            `json:"ca_bundle"`
+	PinnedFingerprint string            `json:"pinned_fingerprint"`
+	SigningSecret     string            `json:"signing_secret"`
+	Policy            Policy            `json:"policy"`
+	RateLimit         *RateLimit        `json:"rate_limit"`
+	MaxAttempts       int               `json:"max_attempts"`
+	MaxAge            Duration          `json:"max_age"`
+	MaxConcurrency    int               `json:"max_concurrency"`
+	Weight            int               `json:"weight"`
+	Ordered           bool              `json:"ordered"`
+	OrderBy           string            `json:"order_by"`
+	Archive           *Archive          `json:"archive"`
+	Failed            *FailedPolicy     `json:"failed"`
+	Destinations      []Destination     `json:"destinations"`
+}
+
+// FindRoute returns the route of the user.
+func FindRoute(routes []Route, username string) (Route, bool) {
+	for _, route := range routes {
+		if route.Username == username {
+			return route, true
+		}
+	}
+
+	return Route{}, false
+}
+
+// Targets returns the destinations of the route. A route without destinations
+// has a single unnamed destination that uses the endpoint settings of the route itself.
+func (r Route) Targets() []Destination {
+	if len(r.Destinations) > 0 {
+		return r.Destinations
+	}
+
+	return []Destination{{
+		Endpoint:          r.Endpoint,
+		Failover:          r.Failover,
+		FailoverAfter:     r.FailoverAfter,
+		FailoverProbe:     r.FailoverProbe,
+		Headers:           r.Headers,
+		BearerToken:       r.BearerToken,
+		BearerTokenFile:   r.BearerTokenFile,
+		BearerTokenEnv:    r.BearerTokenEnv,
+		OAuth2:            r.OAuth2,
+		ClientCertificate: r.ClientCertificate,
+		ClientKey:         r.ClientKey,
+		CABundle:          r.CABundle,
+		PinnedFingerprint: r.PinnedFingerprint,
+		SigningSecret:     r.SigningSecret,
+		Policy:            r.Policy,
+		RateLimit:         r.RateLimit,
+	}}
+}
+
+// Endpoints returns the endpoints of the destinations of the route with the passwords removed.
+func (r Route) Endpoints() string {
+	endpoints := []string{}
+	for _, destination := range r.Targets() {
+		endpoints = append(endpoints, redactURL(destination.Endpoint))
+	}
+
+	return strings.Join(endpoints, ", ")
+}
+
+// Validate returns an error if the scheduling settings or the destinations of the route cannot be used.
+func (r Route) Validate() error {
+	if r.MaxConcurrency < 0 {
+		return errors.New("Max_concurrency must not be negative")
+	}
+
+	if r.Weight < 0 {
+		return errors.New("Weight must not be negative")
+	}
+
+	if r.OrderBy != "" && r.OrderBy != OrderArrival && r.OrderBy != OrderFilename {
+		return fmt.Errorf("Unknown order_by %q, expected %q or %q", r.OrderBy, OrderArrival, OrderFilename)
+	}
+
+	if len(r.Destinations) == 0 {
+		return r.Targets()[0].Validate()
+	}
+
+	if r.Endpoint != "" {
+		return errors.New("Endpoint and destinations cannot be used together")
+	}
+
+	names := make(map[string]bool)
+	required := false
+
+	for _, destination := range r.Destinations {
+		if destination.Name == "" {
+			return errors.New("Destination name is missing")
+		}
+
+		if names[destination.Name] {
+			return fmt.Errorf("Destination %s is listed more than once", destination.Name)
+		}
+
+		names[destination.Name] = true
+
+		if destination.Endpoint == "" {
+			return fmt.Errorf("Destination %s: endpoint is missing", destination.Name)
+		}
+
+		if err := destination.Validate(); err != nil {
+			return fmt.Errorf("Destination %s: %v", destination.Name, err)
+		}
+
+		required = required || !destination.Optional
+	}
+
+	if !required {
+		return errors.New("At least one destination must be required")
+	}
+
+	return nil
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Schedule holds shuttles that are waiting for a retry, ordered by the time of their next attempt.
+// A single goroutine running Schedule.Run moves due shuttles to the dispatcher.
+type Schedule struct {
+	entries  scheduleEntries
+	sequence uint64
+	mutex    *sync.Mutex
+	wake     chan struct{}
+}
+
+// scheduleEntry keeps a sequence number so that shuttles due at the same time keep their order.
+type scheduleEntry struct {
+	shuttle  Shuttle
+	at       time.Time
+	sequence uint64
+}
+
+// scheduleEntries implements heap.Interface.
+type scheduleEntries []scheduleEntry
+
+func (e scheduleEntries) Len() int {
+	return len(e)
+}
+
+func (e scheduleEntries) Less(i, j int) bool {
+	if e[i].at.Equal(e[j].at) {
+		return e[i].sequence < e[j].sequence
+	}
+
+	return e[i].at.Before(e[j].at)
+}
+
+func (e scheduleEntries) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
+
+func (e *scheduleEntries) Push(x interface{}) {
+	*e = append(*e, x.(scheduleEntry))
+}
+
+func (e *scheduleEntries) Pop() interface{} {
+	old := *e
+	entry := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return entry
+}
+
+// NewSchedule creates a new, empty Schedule.
+func NewSchedule() *Schedule {
+	return &Schedule{
+		entries: scheduleEntries{},
+		mutex:   &sync.Mutex{},
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Add schedules the shuttle to be queued at the given time.
+func (s *Schedule) Add(shuttle Shuttle, at time.Time) {
+	s.mutex.Lock()
+	s.sequence++
+	heap.Push(&s.entries, scheduleEntry{
+		shuttle:  shuttle,
+		at:       at,
+		sequence: s.sequence,
+	})
+	s.mutex.Unlock()
+
+	// Wake up the runner in case the new entry is due before the current earliest one
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the amount of scheduled shuttles.
+func (s *Schedule) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.entries)
+}
+
+// Run pushes scheduled shuttles to the dispatcher when they are due, it never returns.
+func (s *Schedule) Run(dispatcher *Dispatcher) {
+	timer := time.NewTimer(time.Hour)
+
+	for {
+		s.mutex.Lock()
+
+		now := time.Now()
+		if len(s.entries) > 0 && !s.entries[0].at.After(now) {
+			entry := heap.Pop(&s.entries).(scheduleEntry)
+			s.mutex.Unlock()
+
+			dispatcher.Push(entry.shuttle)
+			continue
+		}
+
+		wait := time.Hour
+		if len(s.entries) > 0 {
+			wait = s.entries[0].at.Sub(now)
+		}
+
+		s.mutex.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+import "sync"
+
 type Service interface {
 	// Name should return the name of the service.
 	Name() string
@@ -13,11 +15,72 @@ type Service interface {
 	// Stop should gracefully stop the service.
 	Stop() error
 
+	// Status should return the current status of the service.
+	Status() ServiceStatus
+
 	// WriteNotifications should return a channel that file write notifications are sent on.
 	WriteNotifications() chan WriteNotification
 }
 
+// WriteNotification is sent by a service when a client has written a file.
+// Every notification gets a unique transfer ID that follows the file until it has been delivered.
 type WriteNotification struct {
-	Username string
-	Path     string
+	TransferID string
+	Username   string
+	Path       string
+	ClientIP   string
+}
+
+// NewWriteNotification creates a new WriteNotification with a new transfer ID.
+func NewWriteNotification(username string, path string, clientIP string) WriteNotification {
+	return WriteNotification{
+		TransferID: NewTransferID(),
+		Username:   username,
+		Path:       path,
+		ClientIP:   clientIP,
+	}
+}
+
+// ServiceStatus is the status of a service as reported by Service.Status.
+type ServiceStatus struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+	Error   string `json:"error,omitempty"`
+}
+
+// serviceState keeps track of the status of a service, it is safe for concurrent use.
+type serviceState struct {
+	running bool
+	err     error
+	mutex   *sync.RWMutex
+}
+
+func newServiceState() *serviceState {
+	return &serviceState{
+		mutex: &sync.RWMutex{},
+	}
+}
+
+func (s *serviceState) set(running bool, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.running = running
+	s.err = err
+}
+
+func (s *serviceState) status(name string) ServiceStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	status := ServiceStatus{
+		Name:    name,
+		Running: s.running,
+	}
+
+	if s.err != nil {
+		status.Error = s.err.Error()
+	}
+
+	return status
 }
@@ -21,11 +21,15 @@ type SftpService struct {
 	host               string
 	port               int
 	chroot             string
-	incoming           chan sftp.WrittenFile
 	writeNotifications chan WriteNotification
+	state              *serviceState
 	listener           net.Listener
+	listenerMutex      *sync.Mutex
+	stopped            bool
 	servers            map[string]*sftp.Server
+	connections        map[net.Conn]bool
 	serversMutex       *sync.RWMutex
+	clients            *sync.WaitGroup
 	quit               chan bool
 }
 
@@ -37,10 +41,13 @@ func NewSftpService(host string, port int, chroot string, routes []Route, privat
 		host:               host,
 		port:               port,
 		chroot:             chroot,
-		incoming:           make(chan sftp.WrittenFile, 100),
 		writeNotifications: make(chan WriteNotification, 100),
+		state:              newServiceState(),
+		listenerMutex:      &sync.Mutex{},
 		servers:            make(map[string]*sftp.Server),
+		connections:        make(map[net.Conn]bool),
 		serversMutex:       &sync.RWMutex{},
+		clients:            &sync.WaitGroup{},
 		quit:               make(chan bool, 1),
 	}
 }
@@ -65,6 +72,7 @@ func (s *SftpService) Start() error {
 				}
 			}
 
+			authFailures.WithLabelValues(s.Name()).Inc()
 			return nil, fmt.Errorf("password rejected for %q", c.User())
 		},
 	}
@@ -79,7 +87,8 @@ func (s *SftpService) Start() error {
 	s.listener = listener
 
 	go s.accept(config)
-	go s.watchIncoming()
+
+	s.state.set(true, nil)
 
 	return nil
 }
@@ -93,9 +102,15 @@ func (s *SftpService) Reload(routes []Route) error {
 }
 
 func (s *SftpService) Stop() error {
+	s.state.set(false, nil)
 	s.quit <- true
 
-	if err := s.listener.Close(); err != nil {
+	s.listenerMutex.Lock()
+	s.stopped = true
+	err := s.listener.Close()
+	s.listenerMutex.Unlock()
+
+	if err != nil {
 		return err
 	}
 
@@ -108,34 +123,48 @@ func (s *SftpService) Stop() error {
 		}
 	}
 
+	// Connections without an SFTP session, e.g. still in the handshake, are closed as well
+	for conn := range s.connections {
+		conn.Close()
+	}
+
 	s.serversMutex.RUnlock()
 
+	// Wait for the clients to finish so that nothing is written to the channel after it is closed
+	s.clients.Wait()
+
 	// This is really nasty but it works
 	// Wait for the channels to be drained
 	for {
 		writeNotifications := reflect.ValueOf(s.writeNotifications)
-		incoming := reflect.ValueOf(s.incoming)
 
-		if writeNotifications.Len() == 0 && incoming.Len() == 0 {
+		if writeNotifications.Len() == 0 {
 			break
 		}
 
 		time.Sleep(1 * time.Second)
 	}
 
-	close(s.incoming)
 	close(s.writeNotifications)
 
 	return nil
 }
 
+func (s *SftpService) Status() ServiceStatus {
+	return s.state.status(s.Name())
+}
+
 func (s *SftpService) WriteNotifications() chan WriteNotification {
 	return s.writeNotifications
 }
 
 func (s *SftpService) accept(config *ssh.ServerConfig) {
+	s.listenerMutex.Lock()
+	listener := s.listener
+	s.listenerMutex.Unlock()
+
 	for {
-		newConn, err := s.listener.Accept()
+		newConn, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-s.quit:
@@ -143,17 +172,91 @@ func (s *SftpService) accept(config *ssh.ServerConfig) {
 			default:
 			}
 
+			// Temporary errors, e.g. running out of file descriptors, leave the listener open
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Error("Failed to accept incoming SSH connection")
+
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+
+			s.state.set(false, err)
+
 			log.WithFields(log.Fields{
 				"err": err,
-			}).Error("Failed to accept incoming SSH connection")
+			}).Error("SFTP listener closed unexpectedly, reopening after 5 seconds")
+
+			if listener = s.relisten(); listener == nil {
+				return
+			}
+
+			s.state.set(true, nil)
 			continue
 		}
 
+		s.listenerMutex.Lock()
+
+		if s.stopped {
+			s.listenerMutex.Unlock()
+			newConn.Close()
+			return
+		}
+
+		// The connection is registered before Stop can see the service as stopped, so that it is closed too
+		s.clients.Add(1)
+		s.serversMutex.Lock()
+		s.connections[newConn] = true
+		s.serversMutex.Unlock()
+		s.listenerMutex.Unlock()
+
 		go s.handleClient(newConn, config)
 	}
 }
 
+// relisten reopens the listener every 5 seconds until it succeeds, nil if the service was stopped.
+func (s *SftpService) relisten() net.Listener {
+	for {
+		select {
+		case <-s.quit:
+			return nil
+		case <-time.After(5 * time.Second):
+		}
+
+		listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.host, s.port))
+		if err != nil {
+			s.state.set(false, err)
+
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Error("Failed to reopen SFTP listener, retrying after 5 seconds")
+			continue
+		}
+
+		s.listenerMutex.Lock()
+		defer s.listenerMutex.Unlock()
+
+		// Stop closed the old listener while this one was being opened
+		if s.stopped {
+			listener.Close()
+			return nil
+		}
+
+		s.listener = listener
+		return listener
+	}
+}
+
 func (s *SftpService) handleClient(conn net.Conn, config *ssh.ServerConfig) {
+	defer s.clients.Done()
+
+	defer func() {
+		s.serversMutex.Lock()
+		delete(s.connections, conn)
+		s.serversMutex.Unlock()
+	}()
+
 	sessionOpen := false
 
 	go func() {
@@ -181,6 +284,16 @@ func (s *SftpService) handleClient(conn net.Conn, config *ssh.ServerConfig) {
 
 	defer serverConn.Close()
 
+	sessions.WithLabelValues(s.Name()).Inc()
+	defer sessions.WithLabelValues(s.Name()).Dec()
+
+	// Written files are watched per connection so that the address of the client is known
+	incoming := make(chan sftp.WrittenFile, 100)
+	defer close(incoming)
+
+	s.clients.Add(1)
+	go s.watchIncoming(incoming, ClientIP(conn.RemoteAddr().String()))
+
 	// The incoming Request channel must be serviced.
 	go ssh.DiscardRequests(reqs)
 
@@ -225,7 +338,7 @@ func (s *SftpService) handleClient(conn net.Conn, config *ssh.ServerConfig) {
 
 		serverOptions := []sftp.ServerOption{
 			sftp.Chroot(s.chroot),
-			sftp.NotifyWrite(s.incoming),
+			sftp.NotifyWrite(incoming),
 			sftp.AsUser(serverConn.User()),
 			sftp.DisableRemove(),
 		}
@@ -258,13 +371,10 @@ func (s *SftpService) handleClient(conn net.Conn, config *ssh.ServerConfig) {
 	s.serversMutex.Unlock()
 }
 
-func (s *SftpService) watchIncoming() {
-	for writtenFile := range s.incoming {
-		notification := WriteNotification{
-			Username: writtenFile.User,
-			Path:     writtenFile.Path,
-		}
+func (s *SftpService) watchIncoming(incoming chan sftp.WrittenFile, clientIP string) {
+	defer s.clients.Done()
 
-		s.writeNotifications <- notification
+	for writtenFile := range incoming {
+		s.writeNotifications <- NewWriteNotification(writtenFile.User, writtenFile.Path, clientIP)
 	}
 }
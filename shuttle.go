@@ -2,40 +2,104 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// TransferIDHeader is the header that carries the transfer ID of the shuttle to the endpoint.
+const TransferIDHeader = "X-Shuttle-Transfer-ID"
+
+// Limits of the excerpts of the responses that are kept for failed deliveries.
+const (
+	responseExcerptLength       = 1024
+	responseExcerptHeaders      = 32
+	responseExcerptHeaderLength = 256
+)
+
+// ResponseExcerpt is the status code, the headers and the beginning of the body of a response of an endpoint.
+type ResponseExcerpt struct {
+	StatusCode int
+	Headers    map[string]string
+	Body       string
+}
+
+// NewResponseExcerpt reads the beginning of the body of the response, the rest of the body is left unread.
+// Cookies are left out since they might contain credentials.
+func NewResponseExcerpt(response *http.Response) ResponseExcerpt {
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, responseExcerptLength))
+
+	names := []string{}
+	for name := range response.Header {
+		if name != "Set-Cookie" {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	if len(names) > responseExcerptHeaders {
+		names = names[:responseExcerptHeaders]
+	}
+
+	headers := make(map[string]string, len(names))
+	for _, name := range names {
+		value := strings.Join(response.Header[name], ", ")
+		if len(value) > responseExcerptHeaderLength {
+			value = value[:responseExcerptHeaderLength]
+		}
+
+		headers[name] = value
+	}
+
+	return ResponseExcerpt{
+		StatusCode: response.StatusCode,
+		Headers:    headers,
+		Body:       strings.TrimSpace(string(body)),
+	}
+}
+
+// Shuttle is a file on its way to the destinations of its route.
+// The retry state is persisted along with the shuttle so that it survives a restart,
+// Attempts counts the attempts to every destination and Deliveries holds the state of each destination.
+// Cleanups counts the failed attempts to archive or remove the file after it was delivered.
+// The protocol, client IP, size and SHA-256 of the file are recorded in the audit log.
 type Shuttle struct {
-	Path  string
-	Route Route
+	TransferID  string
+	Path        string
+	Route       Route
+	Created     time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	Protocol    string
+	ClientIP    string
+	Size        int64
+	SHA256      string
+	Requeues    int
+	Cleanups    int
+	Deliveries  []Delivery
 }
 
 func NewShuttle(path string, route Route) Shuttle {
 	return Shuttle{
-		Path:  path,
-		Route: route,
+		TransferID: NewTransferID(),
+		Path:       path,
+		Route:      route,
+		Created:    time.Now(),
 	}
 }
 
 func NewShuttleFromUsername(path, username string, routes []Route) (Shuttle, error) {
 	var shuttle Shuttle
-	var route Route
-	var found bool
-
-	for _, otherRoute := range routes {
-		if otherRoute.Username == username {
-			found = true
-			route = otherRoute
-			break
-		}
-	}
 
+	route, found := FindRoute(routes, username)
 	if !found {
 		return shuttle, errors.New("Route missing")
 	}
@@ -44,60 +108,228 @@ func NewShuttleFromUsername(path, username string, routes []Route) (Shuttle, err
 	return shuttle, nil
 }
 
-func (s Shuttle) Send() error {
+// Send sends the file to the destination and returns an excerpt of the response, which is empty if there was none.
+// A TransportError is returned if the destination did not accept the file, it is temporary if the send should be retried.
+func (s Shuttle) Send(destination Destination) (ResponseExcerpt, error) {
+	response, err := s.post(destination, false)
+	if err != nil {
+		return ResponseExcerpt{}, NewTransportError(err, true)
+	}
+
+	httpResponses.WithLabelValues(endpointLabel(destination.Endpoint), strconv.Itoa(response.StatusCode)).Inc()
+
+	// The access token might have been revoked before it expired, retry once with a new one
+	if response.StatusCode == http.StatusUnauthorized && destination.OAuth2 != nil {
+		io.Copy(ioutil.Discard, response.Body)
+		response.Body.Close()
+
+		response, err = s.post(destination, true)
+		if err != nil {
+			return ResponseExcerpt{}, NewTransportError(err, true)
+		}
+
+		httpResponses.WithLabelValues(endpointLabel(destination.Endpoint), strconv.Itoa(response.StatusCode)).Inc()
+	}
+
+	// This can fail but it's probably fine, no need to skip the rest
+	excerpt := NewResponseExcerpt(response)
+	io.Copy(ioutil.Discard, response.Body)
+	defer response.Body.Close()
+
+	switch destination.Policy.Classify(response.StatusCode) {
+	case OutcomeRetry:
+		transportErr := NewTransportError(fmt.Errorf("Server returned %d, retrying later", response.StatusCode), true)
+		transportErr.RetryAfter = ParseRetryAfter(response.Header.Get("Retry-After"))
+
+		return excerpt, transportErr
+
+	case OutcomePermanent:
+		return excerpt, NewTransportError(fmt.Errorf("Server returned %d", response.StatusCode), false)
+	}
+
+	return excerpt, nil
+}
+
+// Complete archives the file of a delivered shuttle if the route has an archive, otherwise the file is removed.
+// Returns the path of the archived file.
+func (s Shuttle) Complete() (string, error) {
+	if s.Route.Archive != nil {
+		return s.Route.Archive.Store(s)
+	}
+
+	return "", os.Remove(s.Path)
+}
+
+// Delivery returns the delivery state of the shuttle for the named destination.
+func (s Shuttle) Delivery(name string) Delivery {
+	for _, delivery := range s.Deliveries {
+		if delivery.Destination == name {
+			return delivery
+		}
+	}
+
+	return Delivery{
+		Destination: name,
+		Status:      DeliveryPending,
+	}
+}
+
+// SetDelivery replaces the delivery state of its destination. The deliveries are copied
+// since the other copies of the shuttle, e.g. the one in Launchpad.Shuttles, might be read concurrently.
+func (s *Shuttle) SetDelivery(delivery Delivery) {
+	deliveries := []Delivery{}
+	for _, current := range s.Deliveries {
+		if current.Destination != delivery.Destination {
+			deliveries = append(deliveries, current)
+		}
+	}
+
+	s.Deliveries = append(deliveries, delivery)
+}
+
+// RetryAt moves the next attempt of the shuttle and every destination it is pending on to the given time.
+func (s *Shuttle) RetryAt(at time.Time) {
+	deliveries := []Delivery{}
+	for _, delivery := range s.Deliveries {
+		if delivery.Status == DeliveryPending {
+			delivery.NextAttempt = at
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	s.Deliveries = deliveries
+	s.NextAttempt = at
+}
+
+// Pending returns the time of the next attempt of the destinations that have not accepted
+// or rejected the file yet. Returns false if there are none, i.e. the shuttle is done.
+func (s Shuttle) Pending() (time.Time, bool) {
+	var next time.Time
+	pending := false
+
+	for _, destination := range s.Route.Targets() {
+		delivery := s.Delivery(destination.Name)
+		if delivery.Status != DeliveryPending {
+			continue
+		}
+
+		if !pending || delivery.NextAttempt.Before(next) {
+			next = delivery.NextAttempt
+		}
+
+		pending = true
+	}
+
+	return next, pending
+}
+
+// Endpoints returns the endpoints that the file was sent to with the passwords removed,
+// or the configured endpoint of the destinations that it has not been sent to yet.
+func (s Shuttle) Endpoints() string {
+	endpoints := []string{}
+	for _, destination := range s.Route.Targets() {
+		endpoint := s.Delivery(destination.Name).Endpoint
+		if endpoint == "" {
+			endpoint = redactURL(destination.Endpoint)
+		}
+
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return strings.Join(endpoints, ", ")
+}
+
+// Fail moves the file to the failed folder and writes the failure metadata next to it.
+// The response is the last response of the endpoint, if any.
+func (s Shuttle) Fail(reason string, response ResponseExcerpt) error {
+	path := filepath.Join(filepath.Dir(s.Path), "failed", filepath.Base(s.Path))
+	if err := os.Rename(s.Path, path); err != nil {
+		return err
+	}
+
+	filesFailed.WithLabelValues(s.Route.Username).Inc()
+
+	event := NewAuditEvent(AuditFailed, s)
+	event.Path = path
+	event.Error = reason
+	event.SetResponse(response)
+	auditLog.Record(event)
+
+	return writeFailure(path, Failure{
+		TransferID:      s.TransferID,
+		Reason:          reason,
+		StatusCode:      response.StatusCode,
+		Response:        response.Body,
+		ResponseHeaders: response.Headers,
+		Endpoint:        s.Endpoints(),
+		Attempts:        s.Attempts,
+		Requeues:        s.Requeues,
+		Failed:          time.Now().UTC(),
+	})
+}
+
+func (s Shuttle) post(destination Destination, refreshToken bool) (*http.Response, error) {
 	params := map[string]string{
-		"username": s.Route.Username,
+		"username":    s.Route.Username,
+		"transfer_id": s.TransferID,
 	}
 
-	body, contentType, err := CreateMultipartForm(s.Path, params)
+	token, err := destination.Token(refreshToken)
 	if err != nil {
-		return NewTransportError(err, true)
+		return nil, err
 	}
 
-	request, err := http.NewRequest("POST", s.Route.Endpoint, body)
+	client, err := destination.Client()
 	if err != nil {
-		return NewTransportError(err, true)
+		return nil, err
 	}
 
-	request.Header.Set("Content-Type", contentType)
-
-	dialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
+	// The digest is needed for the signature before the payload is streamed
+	var digest string
+	if destination.SigningSecret != "" {
+		digest, err = HashFile(s.Path)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			Dial:                  dialer.Dial,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ResponseHeaderTimeout: 10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
+	body, length, contentType, err := CreateMultipartForm(s.Path, params)
+	if err != nil {
+		return nil, err
 	}
 
-	response, err := client.Do(request)
+	// The client closes the body once the request has been written
+	request, err := http.NewRequest("POST", destination.Endpoint, destination.RateLimit.Shape(destination.Endpoint, body))
 	if err != nil {
-		return NewTransportError(err, true)
+		body.Close()
+		return nil, err
 	}
 
-	// This can fail but it's probably fine, no need to skip the rest
-	io.Copy(ioutil.Discard, response.Body)
-	defer response.Body.Close()
+	request.ContentLength = length
 
-	if response.StatusCode < 200 || response.StatusCode > 299 {
-		// Move the file to a failed folder
-		if err := os.Rename(s.Path, filepath.Join(filepath.Dir(s.Path), "failed", filepath.Base(s.Path))); err != nil {
-			return NewTransportError(err, false)
-		}
+	for key, value := range destination.Headers {
+		request.Header.Set(key, value)
+	}
+
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set(TransferIDHeader, s.TransferID)
+
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
 
-		err := errors.New("Server returned non-200, moving to failed folder")
-		return NewTransportError(err, false)
+	if destination.SigningSecret != "" {
+		request.Header.Set("X-Shuttle-Content-SHA256", digest)
+		request.Header.Set(SignatureHeader, destination.Sign(time.Now(), s.Route.Username, filepath.Base(s.Path), digest))
 	}
 
-	// Remove the file
-	if err := os.Remove(s.Path); err != nil {
-		return NewTransportError(err, false)
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	bytesSent.WithLabelValues(s.Route.Username).Add(float64(length))
+
+	return response, nil
 }
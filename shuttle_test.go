@@ -0,0 +1,236 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sendResult is what the test endpoint received.
+type sendResult struct {
+	contentLength int64
+	received      int64
+	fields        map[string]string
+	filename      string
+	size          int64
+	head          []byte
+	tail          []byte
+	err           error
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// tailWriter keeps the last bytes written to it.
+type tailWriter struct {
+	tail []byte
+	size int
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.tail = append(w.tail, p...)
+	if len(w.tail) > w.size {
+		w.tail = append(w.tail[:0], w.tail[len(w.tail)-w.size:]...)
+	}
+
+	return len(p), nil
+}
+
+func TestShuttleSendStreamsLargeFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Sends several gigabytes")
+	}
+
+	const size = 3 << 30
+	head, tail := []byte("head of the payload"), []byte("tail of the payload")
+
+	directory, err := ioutil.TempDir("", "shuttle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(directory)
+
+	// A sparse file takes no space on the disk apart from the head and the tail
+	path := filepath.Join(directory, "large.bin")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		t.Fatal(err)
+	}
+
+	if _, err := file.WriteAt(head, 0); err != nil {
+		file.Close()
+		t.Fatal(err)
+	}
+
+	if _, err := file.WriteAt(tail, size-int64(len(tail))); err != nil {
+		file.Close()
+		t.Fatal(err)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan sendResult, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := sendResult{
+			contentLength: r.ContentLength,
+			fields:        make(map[string]string),
+		}
+
+		body := &countingReader{Reader: r.Body}
+		r.Body = ioutil.NopCloser(body)
+
+		reader, err := r.MultipartReader()
+		if err != nil {
+			result.err = err
+			results <- result
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				result.err = err
+				break
+			}
+
+			if part.FormName() != "payload" {
+				value, _ := ioutil.ReadAll(part)
+				result.fields[part.FormName()] = string(value)
+				continue
+			}
+
+			result.filename = part.FileName()
+			result.head = make([]byte, len(head))
+
+			n, err := io.ReadFull(part, result.head)
+			result.size += int64(n)
+			if err != nil {
+				result.err = err
+				break
+			}
+
+			ending := &tailWriter{size: len(tail)}
+			copied, err := io.Copy(ending, part)
+			result.size += copied
+			result.tail = ending.tail
+
+			if err != nil {
+				result.err = err
+				break
+			}
+		}
+
+		io.Copy(ioutil.Discard, body)
+		result.received = body.count
+
+		results <- result
+	}))
+
+	defer server.Close()
+
+	route := Route{
+		Username: "testuser",
+		Endpoint: server.URL,
+	}
+
+	shuttle := NewShuttle(path, route)
+
+	// Sample the heap while sending, buffering the file would grow it by gigabytes
+	runtime.GC()
+
+	var baseline runtime.MemStats
+	runtime.ReadMemStats(&baseline)
+
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+
+	go func() {
+		defer close(sampled)
+
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+
+			if stats.HeapAlloc > atomic.LoadUint64(&peak) {
+				atomic.StoreUint64(&peak, stats.HeapAlloc)
+			}
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	_, err = shuttle.Send(route.Targets()[0])
+	close(done)
+	<-sampled
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-results
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+
+	if result.contentLength != result.received {
+		t.Errorf("Declared Content-Length %d, received %d bytes", result.contentLength, result.received)
+	}
+
+	if result.fields["username"] != "testuser" || result.fields["transfer_id"] != shuttle.TransferID {
+		t.Errorf("Unexpected form fields %v", result.fields)
+	}
+
+	if result.filename != "large.bin" {
+		t.Errorf("Payload filename is %q", result.filename)
+	}
+
+	if result.size != size {
+		t.Errorf("Payload has %d bytes, expected %d", result.size, size)
+	}
+
+	if string(result.head) != string(head) || string(result.tail) != string(tail) {
+		t.Errorf("Payload starts with %q and ends with %q", result.head, result.tail)
+	}
+
+	const limit = 64 << 20
+	if growth := int64(atomic.LoadUint64(&peak)) - int64(baseline.HeapAlloc); growth > limit {
+		t.Errorf("Heap grew by %d bytes while sending, expected at most %d", growth, limit)
+	}
+}
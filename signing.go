@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// SignatureHeader is the header that carries the request signature.
+const SignatureHeader = "X-Shuttle-Signature"
+
+// Sign returns the value of the signature header for a payload of the user sent to the destination.
+// The signature is a HMAC-SHA256 using the signing secret of the destination over
+// the UNIX timestamp, username, filename and hex encoded SHA-256 digest of the payload,
+// each separated by a newline. The header value has the form "t=<timestamp>,v1=<signature>".
+func (d Destination) Sign(timestamp time.Time, username string, filename string, digest string) string {
+	unix := strconv.FormatInt(timestamp.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(d.SigningSecret))
+	mac.Write([]byte(unix + "\n" + username + "\n" + filename + "\n" + digest))
+
+	return fmt.Sprintf("t=%s,v1=%s", unix, hex.EncodeToString(mac.Sum(nil)))
+}
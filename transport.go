@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client returns a HTTP client that is configured using the TLS options of the destination.
+func (d Destination) Client() (*http.Client, error) {
+	tlsConfig, err := d.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial:                  dialer.Dial,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+
+	return client, nil
+}
+
+func (d Destination) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if d.ClientCertificate != "" || d.ClientKey != "" {
+		certificate, err := tls.LoadX509KeyPair(d.ClientCertificate, d.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	if d.CABundle != "" {
+		bundle, err := ioutil.ReadFile(d.CABundle)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, errors.New("No certificates found in CA bundle")
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if d.PinnedFingerprint != "" {
+		pinned, err := hex.DecodeString(strings.Replace(d.PinnedFingerprint, ":", "", -1))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(pinned) != sha256.Size {
+			return nil, errors.New("Pinned fingerprint is not a SHA-256 hash")
+		}
+
+		// The chain has already been verified at this point, only the leaf is compared
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("Server did not present a certificate")
+			}
+
+			fingerprint := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(fingerprint[:], pinned) {
+				return errors.New("Server certificate does not match the pinned fingerprint")
+			}
+
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
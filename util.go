@@ -2,44 +2,122 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"path"
+	"time"
 )
 
-func CreateMultipartForm(filepath string, params map[string]string) (*bytes.Buffer, string, error) {
+// multipartBody is the streamed body of a multipart form, closing it closes the payload file.
+type multipartBody struct {
+	io.Reader
+	file *os.File
+}
+
+func (b *multipartBody) Close() error {
+	return b.file.Close()
+}
+
+// CreateMultipartForm creates a multipart form with the file as the payload field.
+// The file is streamed from the disk instead of being buffered in memory,
+// only the form fields and boundaries are kept in memory.
+// Returns the body, its length in bytes and the content type.
+func CreateMultipartForm(filepath string, params map[string]string) (io.ReadCloser, int64, string, error) {
 	handle, err := os.Open(filepath)
 	if err != nil {
-		return nil, "", err
+		return nil, 0, "", err
 	}
 
-	defer handle.Close()
-
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	part, err := writer.CreateFormFile("payload", path.Base(filepath))
+	fileinfo, err := handle.Stat()
 	if err != nil {
-		return nil, "", err
+		handle.Close()
+		return nil, 0, "", err
 	}
 
-	if _, err := io.Copy(part, handle); err != nil {
-		return nil, "", err
-	}
+	buffer := &bytes.Buffer{}
+	writer := multipart.NewWriter(buffer)
 
 	for key, value := range params {
 		if err := writer.WriteField(key, value); err != nil {
-			return nil, "", err
+			handle.Close()
+			return nil, 0, "", err
 		}
 	}
 
+	if _, err := writer.CreateFormFile("payload", path.Base(filepath)); err != nil {
+		handle.Close()
+		return nil, 0, "", err
+	}
+
+	head := make([]byte, buffer.Len())
+	copy(head, buffer.Bytes())
+	buffer.Reset()
+
+	// Closing the writer only writes the closing boundary
 	if err := writer.Close(); err != nil {
-		return nil, "", err
+		handle.Close()
+		return nil, 0, "", err
+	}
+
+	tail := buffer.Bytes()
+
+	body := &multipartBody{
+		Reader: io.MultiReader(bytes.NewReader(head), io.LimitReader(handle, fileinfo.Size()), bytes.NewReader(tail)),
+		file:   handle,
 	}
 
-	return body, writer.FormDataContentType(), nil
+	length := int64(len(head)) + fileinfo.Size() + int64(len(tail))
+
+	return body, length, writer.FormDataContentType(), nil
+}
+
+// HashFile returns the hex encoded SHA-256 digest of the file.
+func HashFile(filepath string) (string, error) {
+	handle, err := os.Open(filepath)
+	if err != nil {
+		return "", err
+	}
+
+	defer handle.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, handle); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// NewTransferID returns a random identifier in the UUID version 4 format.
+func NewTransferID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// The system random source failing is not something to recover from
+		panic(err)
+	}
+
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
+// ClientIP returns the IP address of a remote address in the host:port format.
+func ClientIP(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	return host
 }
 
 func DetectContentType(reader io.Reader) (string, error) {
@@ -64,3 +142,27 @@ func SeparateRoutes(routes []Route) (local []Route, external []Route) {
 
 	return
 }
+
+// Duration is a time.Duration that is given in the configuration as a string, e.g. "72h".
+type Duration time.Duration
+
+// UnmarshalJSON parses the duration from a string using time.ParseDuration.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+// MarshalJSON formats the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
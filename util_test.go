@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateMultipartForm(t *testing.T) {
+	directory, err := ioutil.TempDir("", "shuttle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(directory)
+
+	payload := []byte("first line\nsecond line\n")
+	path := filepath.Join(directory, "payload.txt")
+
+	if err := ioutil.WriteFile(path, payload, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	params := map[string]string{
+		"username":    "testuser",
+		"transfer_id": "transfer",
+	}
+
+	body, length, contentType, err := CreateMultipartForm(path, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer body.Close()
+
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int64(len(content)) != length {
+		t.Fatalf("Declared length %d, body has %d bytes", length, len(content))
+	}
+
+	_, mediaParams, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form, err := multipart.NewReader(bytes.NewReader(content), mediaParams["boundary"]).ReadForm(1024 * 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range params {
+		if values := form.Value[key]; len(values) != 1 || values[0] != value {
+			t.Errorf("Field %s is %v, expected %q", key, values, value)
+		}
+	}
+
+	files := form.File["payload"]
+	if len(files) != 1 {
+		t.Fatalf("Expected a single payload, got %d", len(files))
+	}
+
+	if files[0].Filename != "payload.txt" {
+		t.Errorf("Payload filename is %q", files[0].Filename)
+	}
+
+	file, err := files[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	received, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(received, payload) {
+		t.Errorf("Payload is %q, expected %q", received, payload)
+	}
+}
+
+func TestCreateMultipartFormMissingFile(t *testing.T) {
+	if _, _, _, err := CreateMultipartForm(filepath.Join(os.TempDir(), "shuttle-missing"), nil); err == nil {
+		t.Fatal("Expected an error for a missing file")
+	}
+}
@@ -14,6 +14,8 @@ import (
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // WebService is a web server.
@@ -26,9 +28,11 @@ type WebService struct {
 	chroot             string
 	certificate        tls.Certificate
 	writeNotifications chan WriteNotification
+	state              *serviceState
 	server             *http.Server
 	insecureServer     *http.Server
 	rootTemplate       *template.Template
+	failedTemplate     *template.Template
 }
 
 type userFile struct {
@@ -49,7 +53,9 @@ func NewWebService(host string, port int, insecurePort int, allowInsecure bool,
 		chroot:             chroot,
 		certificate:        certificate,
 		writeNotifications: make(chan WriteNotification, 100),
+		state:              newServiceState(),
 		rootTemplate:       template.Must(template.New("root").Parse(rootTemplateSource)),
+		failedTemplate:     template.Must(template.New("failed").Parse(failedTemplateSource)),
 	}
 }
 
@@ -64,6 +70,7 @@ func (s *WebService) Start() error {
 	mux.HandleFunc("/", s.auth(s.serveRoot))
 	mux.HandleFunc("/list", s.auth(s.serveDirectory))
 	mux.HandleFunc("/download", s.auth(s.serveFile))
+	mux.HandleFunc("/failed", s.auth(s.serveFailed))
 	mux.HandleFunc("/upload", s.auth(s.handleUpload))
 
 	tlsConfig := &tls.Config{
@@ -98,8 +105,24 @@ func (s *WebService) Start() error {
 		Handler: insecureHandler,
 	}
 
-	go s.server.ListenAndServeTLS("", "")
-	go s.insecureServer.ListenAndServe()
+	// Listen right away so that failing to bind is noticed
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		s.state.set(false, err)
+		return err
+	}
+
+	insecureListener, err := net.Listen("tcp", s.insecureServer.Addr)
+	if err != nil {
+		listener.Close()
+		s.state.set(false, err)
+		return err
+	}
+
+	go s.serve(s.server, listener, true)
+	go s.serve(s.insecureServer, insecureListener, false)
+
+	s.state.set(true, nil)
 
 	return nil
 }
@@ -112,12 +135,37 @@ func (s *WebService) Reload(routes []Route) error {
 
 // Stop stops the server gracefully.
 func (s *WebService) Stop() error {
+	s.state.set(false, nil)
+
 	// This is not crucial so errors are ignored
 	s.insecureServer.Close()
 
 	return s.server.Shutdown(context.Background())
 }
 
+// Status returns the current status of the service.
+func (s *WebService) Status() ServiceStatus {
+	return s.state.status(s.Name())
+}
+
+func (s *WebService) serve(server *http.Server, listener net.Listener, secure bool) {
+	var err error
+	if secure {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+
+	if err != nil && err != http.ErrServerClosed {
+		s.state.set(false, err)
+
+		log.WithFields(log.Fields{
+			"addr": server.Addr,
+			"err":  err,
+		}).Error("Web server crashed")
+	}
+}
+
 // WriteNotifications returns the file write notification channel.
 func (s *WebService) WriteNotifications() chan WriteNotification {
 	return s.writeNotifications
@@ -135,6 +183,8 @@ func (s *WebService) auth(handler http.HandlerFunc) http.HandlerFunc {
 			}
 		}
 
+		authFailures.WithLabelValues(s.Name()).Inc()
+
 		writer.Header().Set("WWW-Authenticate", `Basic realm="Shuttle"`)
 		http.Error(writer, "Unauthorized.", http.StatusUnauthorized)
 	}
@@ -227,6 +277,21 @@ func (s *WebService) serveDirectory(writer http.ResponseWriter, request *http.Re
 	}
 }
 
+func (s *WebService) serveFailed(writer http.ResponseWriter, request *http.Request) {
+	username, _, _ := request.BasicAuth()
+
+	files, err := ListFailed(s.chroot, username)
+	if err != nil {
+		http.Error(writer, "Error while reading failed folder", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.failedTemplate.Execute(writer, files); err != nil {
+		http.Error(writer, "Templating error", http.StatusInternalServerError)
+		return
+	}
+}
+
 func (s *WebService) serveFile(writer http.ResponseWriter, request *http.Request) {
 	username, _, _ := request.BasicAuth()
 
@@ -290,10 +355,7 @@ func (s *WebService) handleUpload(writer http.ResponseWriter, request *http.Requ
 
 	io.Copy(file, incoming)
 
-	s.writeNotifications <- WriteNotification{
-		Username: username,
-		Path:     path,
-	}
+	s.writeNotifications <- NewWriteNotification(username, path, ClientIP(request.RemoteAddr))
 
 	http.Redirect(writer, request, "/", http.StatusFound)
 }
@@ -328,9 +390,50 @@ const rootTemplateSource = `
 
 	<br />
 
+	<a href="/failed">Failed deliveries</a>
+
+	<br />
+	<br />
+
 	<form action="/upload" method="post" enctype="multipart/form-data">
 		<label>Select a file to upload</label><br />
 		<input type="file" name="file" />
 		<input type="submit" value="Upload" />
 	</form>
 `
+
+const failedTemplateSource = `
+	<table>
+		<thead>
+			<tr>
+				<th>Failed</th>
+				<th>Name</th>
+				<th>Reason</th>
+				<th>Status</th>
+				<th>Response</th>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .}}
+				<tr>
+					<td>{{.Failed.Format "Jan 2 15:04"}}</td>
+					<td>{{.Name}}</td>
+					<td>{{.Reason}}</td>
+					<td>{{if .StatusCode}}{{.StatusCode}}{{end}}</td>
+					<td>
+						{{range $name, $value := .ResponseHeaders}}
+							{{$name}}: {{$value}}<br />
+						{{end}}
+						{{if .Response}}
+							<pre>{{.Response}}</pre>
+						{{end}}
+					</td>
+				</tr>
+			{{end}}
+		</tbody>
+	</table>
+
+	<br />
+
+	<a href="/">Back</a>
+`